@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// principal is who an authenticated request acts for: the admin, who may act for every athlete, or a single
+// athlete.
+type principal struct {
+	admin     bool
+	athleteID int
+}
+
+type principalKey struct{}
+
+// athleteAPIKey returns the API key of an athlete, "{athlete id}.{signature}". Keys are signed with the signing
+// secret rather than stored, so rotating the secret revokes all of them.
+func athleteAPIKey(athleteID int) string {
+	return fmt.Sprintf("%d.%s", athleteID, sign(fmt.Sprintf("athlete:%d", athleteID)))
+}
+
+// sign returns the URL safe HMAC-SHA256 of a value with the signing secret.
+func sign(value string) string {
+	mac := hmac.New(sha256.New, []byte(config.Auth.SigningSecret))
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseAPIKey returns who an API key belongs to.
+func parseAPIKey(key string) (principal, bool) {
+	if key == "" {
+		return principal{}, false
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(config.Auth.AdminAPIKey)) == 1 {
+		return principal{admin: true}, true
+	}
+
+	id, _, found := strings.Cut(key, ".")
+	if !found {
+		return principal{}, false
+	}
+	athleteID, err := strconv.Atoi(id)
+	if err != nil {
+		return principal{}, false
+	}
+	if !hmac.Equal([]byte(key), []byte(athleteAPIKey(athleteID))) {
+		return principal{}, false
+	}
+	return principal{athleteID: athleteID}, true
+}
+
+// requestAPIKey reads the API key from the Authorization bearer header, or the X-API-Key header.
+func requestAPIKey(r *http.Request) string {
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimPrefix(authorization, "Bearer ")
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// requireAuth rejects the requests that don't carry a valid API key or come from a logged in browser. Handlers
+// check the athlete they act for with authorizeAthlete.
+func requireAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := parseAPIKey(requestAPIKey(r))
+		if !ok {
+			p.athleteID, ok = sessionAthlete(r)
+			if ok && r.Method != "GET" && r.Method != "HEAD" && !isSameOrigin(r) {
+				http.Error(w, "Cross-site requests are not allowed", http.StatusForbidden)
+				return
+			}
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "A valid API key is required", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// requireAdmin only lets the admin API key through.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if !requestPrincipal(r).admin {
+			http.Error(w, "Only the admin may do this", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+func requestPrincipal(r *http.Request) principal {
+	p, _ := r.Context().Value(principalKey{}).(principal)
+	return p
+}
+
+// authorizeAthlete reports whether the request may act for the athlete, and answers with a 403 when it may not.
+func authorizeAthlete(w http.ResponseWriter, r *http.Request, athleteID int) bool {
+	p := requestPrincipal(r)
+	if p.admin || p.athleteID == athleteID {
+		return true
+	}
+	http.Error(w, fmt.Sprintf("Not allowed to act for athlete %d", athleteID), http.StatusForbidden)
+	return false
+}
+
+// athleteIDParam returns the athlete a request is for: the athlete_id query parameter, or else the athlete the API
+// key belongs to, or else the main athlete.
+func athleteIDParam(r *http.Request) (int, error) {
+	if id := r.URL.Query().Get("athlete_id"); id != "" {
+		return strconv.Atoi(id)
+	}
+	if p := requestPrincipal(r); !p.admin && p.athleteID != 0 {
+		return p.athleteID, nil
+	}
+	return AthleteID, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useAuthConfig sets the API keys and the signing secret for the duration of a test.
+func useAuthConfig(t *testing.T, adminAPIKey string, signingSecret string) {
+	previous := config.Auth
+	config.Auth.AdminAPIKey = adminAPIKey
+	config.Auth.SigningSecret = signingSecret
+	t.Cleanup(func() { config.Auth = previous })
+}
+
+func TestParseAPIKey(t *testing.T) {
+	useAuthConfig(t, "admin-key", "signing-secret")
+	key := athleteAPIKey(1234)
+	_, signature, _ := strings.Cut(key, ".")
+
+	useAuthConfig(t, "admin-key", "another-secret")
+	otherSecretKey := athleteAPIKey(1234)
+	useAuthConfig(t, "admin-key", "signing-secret")
+
+	tests := []struct {
+		name   string
+		key    string
+		want   principal
+		wantOK bool
+	}{
+		{"athlete key", key, principal{athleteID: 1234}, true},
+		{"admin key", "admin-key", principal{admin: true}, true},
+		{"empty key", "", principal{}, false},
+		{"no signature", "1234", principal{}, false},
+		{"not an athlete id", "athlete." + signature, principal{}, false},
+		{"bad signature", "1234.bm90LWEtc2lnbmF0dXJl", principal{}, false},
+		{"truncated signature", key[:len(key)-1], principal{}, false},
+		{"signed with another secret", otherSecretKey, principal{}, false},
+		{"signature of another athlete", "4321." + signature, principal{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseAPIKey(tt.key)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("parseAPIKey(%q) = %+v, %t, want %+v, %t", tt.key, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestAuthorizeAthlete(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal principal
+		athleteID int
+		want      bool
+	}{
+		{"own athlete", principal{athleteID: 1234}, 1234, true},
+		{"another athlete", principal{athleteID: 1234}, 4321, false},
+		{"admin", principal{admin: true}, 4321, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/settings", nil)
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, tt.principal))
+			w := httptest.NewRecorder()
+			if got := authorizeAthlete(w, r, tt.athleteID); got != tt.want {
+				t.Errorf("authorizeAthlete() = %t, want %t", got, tt.want)
+			}
+			if !tt.want && w.Code != http.StatusForbidden {
+				t.Errorf("authorizeAthlete() answered %d, want %d", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backfillStatusRunning = "running"
+	backfillStatusDone    = "done"
+	backfillStatusFailed  = "failed"
+)
+
+const (
+	sourceBackfill = "backfill"
+	// backfillBudgetShare is the part of Strava's rate limits a backfill may use, the rest is left for webhooks
+	// and the scheduler.
+	backfillBudgetShare   = 0.6
+	defaultBackfillWorker = 2
+	// A backfill that hasn't checkpointed for this long is assumed to belong to an instance that crashed.
+	backfillStaleAfter = 30 * time.Minute
+)
+
+// BackfillJob walks an athlete's activity history, newest first, one page at a time. The page it is at is
+// checkpointed after every page, so an interrupted backfill resumes where it stopped. Each activity it is done with,
+// or failed on, is recorded in backfill_activities, an activity that fails doesn't hold the backfill up.
+type BackfillJob struct {
+	AthleteID  int       `json:"athlete_id"`
+	Status     string    `json:"status"`
+	Rename     bool      `json:"rename"`
+	Describe   bool      `json:"describe"`
+	Before     int64     `json:"before"`
+	Page       int       `json:"page"`
+	Processed  int       `json:"processed"`
+	Classified int       `json:"classified"`
+	Updated    int       `json:"updated"`
+	Failed     int       `json:"failed"`
+	LastError  string    `json:"last_error,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func createBackfillJobsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS backfill_jobs (
+		athlete_id BIGINT PRIMARY KEY,
+		status VARCHAR(16) NOT NULL,
+		rename_activities BOOLEAN NOT NULL,
+		describe_activities BOOLEAN NOT NULL,
+		before_epoch BIGINT NOT NULL,
+		page INT NOT NULL,
+		processed INT NOT NULL,
+		classified INT NOT NULL,
+		updated INT NOT NULL,
+		failed INT NOT NULL DEFAULT 0,
+		last_error TEXT,
+		updated_at DATETIME NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+	err = addColumnIfMissing(db, "backfill_jobs", "failed", "INT NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS backfill_activities (
+		activity_id BIGINT PRIMARY KEY,
+		athlete_id BIGINT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		error TEXT,
+		updated_at DATETIME NOT NULL,
+		INDEX (athlete_id)
+	);`)
+	return err
+}
+
+// isBackfillDone reports whether a backfill is done with the activity. Failed activities are tried again by the
+// next backfill.
+func isBackfillDone(db *sql.DB, activityID int) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM backfill_activities WHERE activity_id=? AND status=?;", activityID, backfillStatusDone).Scan(&count)
+	return count > 0, err
+}
+
+// recordBackfillActivity records that the backfill is done with the activity, or failed on it when err isn't nil.
+func recordBackfillActivity(db *sql.DB, athleteID int, activityID int, err error) error {
+	status, message := backfillStatusDone, ""
+	if err != nil {
+		status, message = backfillStatusFailed, err.Error()
+	}
+	_, err = db.Exec("REPLACE INTO backfill_activities (activity_id, athlete_id, status, error, updated_at) VALUES (?, ?, ?, ?, ?);",
+		activityID, athleteID, status, message, time.Now())
+	return err
+}
+
+func getBackfillJob(db *sql.DB, athleteID int) (BackfillJob, error) {
+	var job BackfillJob
+	var lastError sql.NullString
+	err := db.QueryRow("SELECT athlete_id, status, rename_activities, describe_activities, before_epoch, page, processed, classified, updated, failed, last_error, updated_at FROM backfill_jobs WHERE athlete_id=?;", athleteID).
+		Scan(&job.AthleteID, &job.Status, &job.Rename, &job.Describe, &job.Before, &job.Page, &job.Processed, &job.Classified, &job.Updated, &job.Failed, &lastError, &job.UpdatedAt)
+	job.LastError = lastError.String
+	return job, err
+}
+
+func saveBackfillJob(db *sql.DB, job BackfillJob) error {
+	_, err := db.Exec("REPLACE INTO backfill_jobs (athlete_id, status, rename_activities, describe_activities, before_epoch, page, processed, classified, updated, failed, last_error, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);",
+		job.AthleteID, job.Status, job.Rename, job.Describe, job.Before, job.Page, job.Processed, job.Classified, job.Updated, job.Failed, job.LastError, time.Now())
+	return err
+}
+
+func backfillStatus(athleteID int) (BackfillJob, error) {
+	db, err := database()
+	if err != nil {
+		return BackfillJob{}, err
+	}
+
+	err = createBackfillJobsTable(db)
+	if err != nil {
+		return BackfillJob{}, err
+	}
+
+	job, err := getBackfillJob(db, athleteID)
+	if err == sql.ErrNoRows {
+		return BackfillJob{}, fmt.Errorf("athlete %d has no backfill", athleteID)
+	}
+	return job, err
+}
+
+// prepareBackfillJob resumes the athlete's unfinished backfill, or starts a new one.
+func prepareBackfillJob(db *sql.DB, athleteID int, rename bool, describe bool, restart bool) (BackfillJob, error) {
+	job, err := getBackfillJob(db, athleteID)
+	if err != nil && err != sql.ErrNoRows {
+		return BackfillJob{}, err
+	}
+
+	if err == nil && !restart && job.Status != backfillStatusDone {
+		if job.Status == backfillStatusRunning && time.Since(job.UpdatedAt) < backfillStaleAfter {
+			return BackfillJob{}, fmt.Errorf("a backfill of athlete %d is already running", athleteID)
+		}
+		fmt.Printf("Resuming the backfill of athlete %d from page %d\n", athleteID, job.Page)
+		job.Status = backfillStatusRunning
+		return job, saveBackfillJob(db, job)
+	}
+
+	job = BackfillJob{
+		AthleteID: athleteID,
+		Status:    backfillStatusRunning,
+		Rename:    rename,
+		Describe:  describe,
+		// Pages are walked with a fixed upper bound, so new uploads don't shift activities between pages.
+		Before: time.Now().Unix(),
+		Page:   1,
+	}
+	return job, saveBackfillJob(db, job)
+}
+
+// buildActivityPrompt asks for a short description of a single activity, following the hashtags the athlete put on
+// it.
+func buildActivityPrompt(workout Workout, kind string, settings AthleteSettings) string {
+	tags, workout := readHashtags(workout)
+	settings = tags.applyTo(settings)
+	loc := settings.locale()
+	return fmt.Sprintf("%s Please write a short description for this %s of mine:\n\n"+
+		"- %s (%s, %s): %s. %s %s\n\n"+
+		"Make it feel as human as possible, concise and without a lot of empty words. You can use emojis if it make sense. "+
+		"Don't use markdown format, since it will not work when displayed.%s%s",
+		settings.coachRole(coachKind([]Workout{workout})), activityNoun(workout.SportType),
+		kind, loc.date(localStartDate(workout), "Monday 2 January 2006"), workout.Name,
+		activityDigest(workout, loc),
+		workout.Description, tags.notes(), weatherInstructions([]Workout{workout}), settings.writingInstructions())
+}
+
+// backfillWorkout classifies one activity from the history and, when the job asks for it, renames and describes it.
+// It returns whether the run was classified and whether it was updated on Strava. Activities it classified are
+// recorded as done, with or without an update, so a resumed backfill skips them.
+func backfillWorkout(db *sql.DB, job BackfillJob, settings AthleteSettings, summary Workout, accessToken string) (bool, bool, error) {
+	if _, ok := classifyWorkout(summary); !ok || !settings.processes(summary) {
+		return false, false, nil
+	}
+
+	done, err := isBackfillDone(db, summary.ID)
+	if err != nil || done {
+		return false, false, err
+	}
+
+	// Laps only come with the detailed activity
+	workout, err := detailedActivity(summary.ID, accessToken, backfillBudgetShare)
+	if err != nil {
+		return false, false, err
+	}
+	if reason := settings.skipReason(workout); reason != "" {
+		fmt.Printf("Activity %d is %s, leaving it alone\n", workout.ID, reason)
+		return false, false, nil
+	}
+	// The history's records fill the PR history, they're not celebrated on activities that are long done
+	_, err = detectPersonalRecords(workout, accessToken, backfillBudgetShare)
+	if err != nil {
+		fmt.Printf("Failed to detect the records of activity %d: %s\n", workout.ID, err)
+	}
+
+	kind, _ := classifyWorkout(workout)
+	fmt.Printf("Activity %d (%s) is a %s\n", workout.ID, localStartDate(workout).Format(recapDateLayout), kind)
+
+	if !job.Rename && !job.Describe {
+		return true, false, recordBackfillActivity(db, job.AthleteID, workout.ID, nil)
+	}
+
+	// The hashtags Stratonova followed are removed from what it writes back
+	_, cleaned := readHashtags(workout)
+	name, description := cleaned.Name, cleaned.Description
+	if job.Rename {
+		name = settings.locale().translate(kind)
+	}
+	if job.Describe {
+		description, err = generateSummary(buildActivityPrompt(workout, kind, settings))
+		if err != nil {
+			return true, false, err
+		}
+	}
+
+	// updateWorkout fetches the activity again before updating it
+	waitForStravaBudget(backfillBudgetShare)
+	waitForStravaBudget(backfillBudgetShare)
+	err = updateWorkout(workout.ID, description, name, accessToken, sourceBackfill)
+	if err != nil {
+		return true, false, err
+	}
+	return true, true, recordBackfillActivity(db, job.AthleteID, workout.ID, nil)
+}
+
+// runBackfill walks the athlete's whole activity history with a pool of workers, checkpointing after every page.
+func runBackfill(athleteID int, rename bool, describe bool, restart bool, workers int) error {
+	if workers < 1 {
+		workers = defaultBackfillWorker
+	}
+
+	db, err := database()
+	if err != nil {
+		return err
+	}
+
+	err = createBackfillJobsTable(db)
+	if err != nil {
+		return err
+	}
+
+	job, err := prepareBackfillJob(db, athleteID, rename, describe, restart)
+	if err != nil {
+		return err
+	}
+	settings := settingsOrDefault(athleteID)
+
+	for {
+		// The token is looked up again for every page, a long backfill outlives an access token.
+		accessToken, err := getAccessTokenForAthlete(athleteID)
+		if err != nil {
+			job.Status = backfillStatusFailed
+			job.LastError = err.Error()
+			saveBackfillJob(db, job)
+			return err
+		}
+
+		waitForStravaBudget(backfillBudgetShare)
+		workouts, err := fetchWorkoutsPage(accessToken, 0, job.Before, job.Page)
+		if err != nil {
+			job.Status = backfillStatusFailed
+			job.LastError = err.Error()
+			saveBackfillJob(db, job)
+			return fmt.Errorf("failed to fetch page %d: %w", job.Page, err)
+		}
+		err = storeActivities(workouts, false)
+		if err != nil {
+			fmt.Printf("Failed to store page %d of athlete %d's activities: %s\n", job.Page, athleteID, err)
+		}
+
+		// Workers read the options from a copy, the counters of job are updated while they run.
+		options := job
+		var mu sync.Mutex
+		var errs []string
+		var wg sync.WaitGroup
+		queue := make(chan Workout)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for w := range queue {
+					classified, updated, err := backfillWorkout(db, options, settings, w, accessToken)
+					if err != nil {
+						fmt.Printf("Backfill of athlete %d failed on activity %d: %s\n", athleteID, w.ID, err)
+						recordErr := recordBackfillActivity(db, athleteID, w.ID, err)
+						if recordErr != nil {
+							fmt.Printf("Failed to record the failure of activity %d: %s\n", w.ID, recordErr)
+						}
+					}
+					mu.Lock()
+					job.Processed++
+					if classified {
+						job.Classified++
+					}
+					if updated {
+						job.Updated++
+					}
+					if err != nil {
+						job.Failed++
+						errs = append(errs, fmt.Sprintf("activity %d: %s", w.ID, err))
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		for _, w := range workouts {
+			queue <- w
+		}
+		close(queue)
+		wg.Wait()
+
+		// Failed activities are recorded and left for the next backfill, the page is done anyway
+		if len(errs) > 0 {
+			job.LastError = strings.Join(errs, "; ")
+		}
+
+		fmt.Printf("Backfill of athlete %d: page %d done, %d activities processed, %d classified, %d updated, %d failed\n",
+			athleteID, job.Page, job.Processed, job.Classified, job.Updated, job.Failed)
+
+		job.Page++
+		if len(workouts) < workoutsPerPage {
+			job.Status = backfillStatusDone
+		}
+		err = saveBackfillJob(db, job)
+		if err != nil {
+			return err
+		}
+		if job.Status == backfillStatusDone {
+			return nil
+		}
+	}
+}
+
+// backfillHandler shows the progress of an athlete's backfill on GET, and starts or resumes it in the background
+// on POST with ?rename=true&describe=true&restart=true&workers={n} as options.
+func backfillHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	athleteID, err := strconv.Atoi(query.Get("athlete_id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid athlete id 🙃🙃🙃: %s", err), http.StatusBadRequest)
+		return
+	}
+	if !authorizeAthlete(w, r, athleteID) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		job, err := backfillStatus(athleteID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	case "POST":
+		workers, _ := strconv.Atoi(query.Get("workers"))
+		go func() {
+			err := runBackfill(athleteID, query.Get("rename") == "true", query.Get("describe") == "true", query.Get("restart") == "true", workers)
+			if err != nil {
+				fmt.Println("Backfill failed:", err)
+			}
+		}()
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Backfill of athlete %d started, follow it on GET /backfill?athlete_id=%d", athleteID, athleteID)
+	default:
+		http.Error(w, "Sorry, only GET and POST are supported", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,785 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// command is a CLI subcommand. Commands share the internals of the HTTP handlers, so anything the service does can
+// also be done from a terminal.
+type command struct {
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+// commands is filled in init, the commands refer back to it for their usage.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"serve": {
+			usage:       "serve [-addr :8080]",
+			description: "start the HTTP server, the webhook workers and the recap scheduler",
+			run:         runServeCommand,
+		},
+		"summarize": {
+			usage:       "summarize -athlete <id> [-week <YYYY-MM-DD>] [-post]",
+			description: "generate the weekly summary of the week a date falls in (this week by default), and post it",
+			run:         runSummarizeCommand,
+		},
+		"classify": {
+			usage:       "classify -activity <id> -athlete <id> [-rename]",
+			description: "tell what kind of training an activity was, and rename it accordingly",
+			run:         runClassifyCommand,
+		},
+		"tokens": {
+			usage:       "tokens list | refresh -athlete <id> | revoke -athlete <id>",
+			description: "list, force refresh or revoke the athletes' Strava tokens",
+			run:         runTokensCommand,
+		},
+		"backfill": {
+			usage:       "backfill -athlete <id> [-rename] [-describe] [-restart] [-workers <n>] | backfill status -athlete <id>",
+			description: "classify, and optionally rename and describe, the athlete's past activities",
+			run:         runBackfillCommand,
+		},
+		"webhook": {
+			usage:       "webhook simulate -object <id> [-owner <id>] [-type activity] [-aspect create] [-updates k=v,...] [-url <url> | -process]",
+			description: "send a fake Strava webhook event to a running server, or process it right here",
+			run:         runWebhookCommand,
+		},
+		"history": {
+			usage:       "history -activity <id>",
+			description: "list the changes Stratonova made to an activity",
+			run:         runHistoryCommand,
+		},
+		"undo": {
+			usage:       "undo -change <id>",
+			description: "restore an activity to how it was before a change",
+			run:         runUndoCommand,
+		},
+		"subscriptions": {
+			usage:       "subscriptions list | create | delete -id <id> | verify",
+			description: "manage the Strava webhook subscription",
+			run:         runSubscriptionsCommand,
+		},
+		"schedule": {
+			usage:       "schedule -athlete <id> [-weekday 0] [-at 20:00] [-timezone <tz>] [-week-start 1] [-periods week,month]",
+			description: "set when the athlete's recaps are generated, weekday 0 is Sunday, unset flags keep their current value",
+			run:         runScheduleCommand,
+		},
+		"settings": {
+			usage:       "settings -athlete <id> [-tone friendly] [-language English] [-units metric|imperial] [-rename=false] [-sports Run,Ride] [-plan swim=3,ride=6,run=4] [-skip-commutes] [-skip-trainer] [-skip-private] [-skip-manual] [-min-distance 1000] [-min-duration 10m] [-exclude-sports Walk] [-exclude-gear b1234]",
+			description: "show or change the athlete's settings, unset flags keep their current value, the recap schedule is set with schedule",
+			run:         runSettingsCommand,
+		},
+		"recaps": {
+			usage:       "recaps -athlete <id> [-period week|month|quarter|year]",
+			description: "list the athlete's recaps",
+			run:         runRecapsCommand,
+		},
+		"sync": {
+			usage:       "sync -athlete <id> [-from <YYYY-MM-DD>]",
+			description: "store the athlete's activities started since the last sync, and since a date when the store doesn't go back that far",
+			run:         runSyncCommand,
+		},
+		"records": {
+			usage:       "records -athlete <id>",
+			description: "list the athlete's personal records",
+			run:         runRecordsCommand,
+		},
+		"apikey": {
+			usage:       "apikey -athlete <id>",
+			description: "print the API key an athlete authenticates to the HTTP endpoints with",
+			run:         runAPIKeyCommand,
+		},
+		"config": {
+			usage:       "config",
+			description: "print the configuration, with secrets redacted, and check it",
+			run:         runConfigCommand,
+		},
+		"recap": {
+			usage:       "recap -athlete <id> -period week|month|quarter|year [-date <YYYY-MM-DD>] | recap -athlete <id> -period block -from <YYYY-MM-DD> -to <YYYY-MM-DD>",
+			description: "generate the recap of the period a date falls in (today by default), or of a training block",
+			run:         runRecapCommand,
+		},
+	}
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprint(os.Stderr, "usage: stratonova [-config <file>] [-public-url <url>] [-llm-model <model>] <command> [flags], without a command the server is started\n\ncommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n      %s\n", commands[name].usage, commands[name].description)
+	}
+}
+
+// runCommand loads the configuration from the global flags in front of the subcommand, and runs the subcommand.
+func runCommand(args []string) error {
+	cfg, args, err := loadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		printUsage()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	config = cfg
+
+	// Without a command the binary starts the server, like it always did
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		printUsage()
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			return nil
+		}
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	// The config command prints the configuration even when it is invalid, to help fixing it.
+	if args[0] != "config" {
+		err = config.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = cmd.run(args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
+
+// newFlagSet returns the flag set of a command, printing the command's usage on -h or a parse error.
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: stratonova %s\n", commands[name].usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func requireFlag(name string, value int) error {
+	if value == 0 {
+		return fmt.Errorf("the -%s flag is required", name)
+	}
+	return nil
+}
+
+func usageError(name string) error {
+	return fmt.Errorf("usage: stratonova %s", commands[name].usage)
+}
+
+func runServeCommand(args []string) error {
+	flags := newFlagSet("serve")
+	addr := flags.String("addr", config.Server.Addr, "address the HTTP server listens on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	return serve(*addr)
+}
+
+func runSummarizeCommand(args []string) error {
+	flags := newFlagSet("summarize")
+	athleteID := flags.Int("athlete", 0, "athlete id")
+	week := flags.String("week", "", "any date in the week to summarize, YYYY-MM-DD")
+	post := flags.Bool("post", false, "post the summary on the last run of the week")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag("athlete", *athleteID); err != nil {
+		return err
+	}
+
+	accessToken, err := getAccessTokenForAthlete(*athleteID)
+	if err != nil {
+		return err
+	}
+	loc, weekStartDay := athleteCalendar(*athleteID, accessToken)
+	weekStart, weekEnd, err := resolveRecapPeriod(periodWeek, *week, "", "", loc, weekStartDay)
+	if err != nil {
+		return err
+	}
+
+	if *post {
+		status, activityID, summary, err := runWeeklyRecap(*athleteID, weekStart, weekEnd, time.Now())
+		if err != nil {
+			return err
+		}
+		fmt.Println(summary)
+		fmt.Printf("\nRecap %s (activity %d)\n", status, activityID)
+		return nil
+	}
+
+	before := weekEnd
+	if now := time.Now(); now.Before(before) {
+		before = now
+	}
+	workouts, err := activitiesBetween(*athleteID, accessToken, weekStart, before)
+	if err != nil {
+		return err
+	}
+	summary, title, err := generateWeeklySummary(workouts, weekStart, weekEnd, settingsOrDefault(*athleteID))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n%s\n", strings.TrimSpace(title), summary)
+	return nil
+}
+
+func runClassifyCommand(args []string) error {
+	flags := newFlagSet("classify")
+	activityID := flags.Int("activity", 0, "activity id")
+	athleteID := flags.Int("athlete", 0, "id of the athlete owning the activity")
+	rename := flags.Bool("rename", false, "rename the activity after the kind of training")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag("activity", *activityID); err != nil {
+		return err
+	}
+	if err := requireFlag("athlete", *athleteID); err != nil {
+		return err
+	}
+
+	accessToken, err := getAccessTokenForAthlete(*athleteID)
+	if err != nil {
+		return err
+	}
+	workout, err := fetchWorkout(*activityID, accessToken)
+	if err != nil {
+		return err
+	}
+	kind, ok := classifyWorkout(workout)
+	if !ok {
+		return fmt.Errorf("activity %d is a %s, Stratonova has no classifier for it", workout.ID, workout.SportType)
+	}
+	fmt.Printf("%s: %s\n", workout.Name, kind)
+	if *rename {
+		return updateWorkout(workout.ID, workout.Description, kind, accessToken, sourceClassifier)
+	}
+	return nil
+}
+
+func runTokensCommand(args []string) error {
+	if len(args) == 0 {
+		return usageError("tokens")
+	}
+
+	flags := newFlagSet("tokens")
+	athleteID := flags.Int("athlete", 0, "athlete id")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		tokens, err := listAccessTokens()
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			state := "valid"
+			if token.ExpiresAt.Before(time.Now()) {
+				state = "expired"
+			}
+			fmt.Printf("athlete %d: %s until %s\n", token.AthleteId, state, token.ExpiresAt.Format("2006-01-02 15:04"))
+		}
+		return nil
+	case "refresh":
+		if err := requireFlag("athlete", *athleteID); err != nil {
+			return err
+		}
+		token, err := refreshAccessToken(*athleteID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Token of athlete %d refreshed, valid until %s\n", *athleteID, time.Unix(token.ExpiresAt, 0).Format("2006-01-02 15:04"))
+		return nil
+	case "revoke":
+		if err := requireFlag("athlete", *athleteID); err != nil {
+			return err
+		}
+		err := revokeAthlete(*athleteID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Athlete %d revoked and purged\n", *athleteID)
+		return nil
+	}
+	return usageError("tokens")
+}
+
+func runBackfillCommand(args []string) error {
+	status := len(args) > 0 && args[0] == "status"
+	if status {
+		args = args[1:]
+	}
+
+	flags := newFlagSet("backfill")
+	athleteID := flags.Int("athlete", 0, "athlete id")
+	rename := flags.Bool("rename", false, "rename the activities after the kind of training")
+	describe := flags.Bool("describe", false, "write a description for the activities")
+	restart := flags.Bool("restart", false, "start over instead of resuming")
+	workers := flags.Int("workers", defaultBackfillWorker, "number of activities processed at the same time")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag("athlete", *athleteID); err != nil {
+		return err
+	}
+
+	if status {
+		job, err := backfillStatus(*athleteID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s at page %d: %d activities processed, %d classified, %d updated, %d failed %s\n",
+			job.Status, job.Page, job.Processed, job.Classified, job.Updated, job.Failed, job.LastError)
+		return nil
+	}
+	return runBackfill(*athleteID, *rename, *describe, *restart, *workers)
+}
+
+func runWebhookCommand(args []string) error {
+	if len(args) == 0 || args[0] != "simulate" {
+		return usageError("webhook")
+	}
+
+	flags := newFlagSet("webhook")
+	objectType := flags.String("type", objectTypeActivity, "object type, activity or athlete")
+	aspectType := flags.String("aspect", aspectTypeCreate, "aspect type, create, update or delete")
+	objectID := flags.Int("object", 0, "activity or athlete id")
+	ownerID := flags.Int("owner", AthleteID, "athlete id")
+	updates := flags.String("updates", "", "comma separated updates, e.g. title=Morning Run,authorized=false")
+	target := flags.String("url", "http://localhost:8080/webhook", "webhook endpoint to send the event to")
+	process := flags.Bool("process", false, "process the event right here instead of sending it")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if err := requireFlag("object", *objectID); err != nil {
+		return err
+	}
+
+	event := WebhookEvent{
+		ObjectType: *objectType,
+		ObjectId:   *objectID,
+		AspectType: *aspectType,
+		OwnerId:    *ownerID,
+		EventTime:  time.Now().Unix(),
+		Updates:    map[string]string{},
+	}
+	for _, update := range strings.Split(*updates, ",") {
+		if key, value, ok := strings.Cut(update, "="); ok {
+			event.Updates[key] = value
+		}
+	}
+
+	if *process {
+		return processWebhookEvent(event)
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(*target, "application/json", strings.NewReader(string(payload)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Printf("%s answered %d %s\n", *target, resp.StatusCode, string(body))
+	return nil
+}
+
+func runHistoryCommand(args []string) error {
+	flags := newFlagSet("history")
+	activityID := flags.Int("activity", 0, "activity id")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag("activity", *activityID); err != nil {
+		return err
+	}
+
+	changes, err := listActivityChanges(*activityID)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		fmt.Printf("#%d %s [%s] %q -> %q\n", c.ID, c.CreatedAt.Format("2006-01-02 15:04"), c.Source, c.PreviousName, c.NewName)
+	}
+	return nil
+}
+
+func runSyncCommand(args []string) error {
+	flags := newFlagSet("sync")
+	athleteID := flags.Int("athlete", 0, "athlete id")
+	from := flags.String("from", "", "date the store should go back to, YYYY-MM-DD")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag("athlete", *athleteID); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if *from != "" {
+		var err error
+		start, err = time.Parse(recapDateLayout, *from)
+		if err != nil {
+			return fmt.Errorf("invalid date %q: %w", *from, err)
+		}
+	}
+	accessToken, err := getAccessTokenForAthlete(*athleteID)
+	if err != nil {
+		return err
+	}
+	return syncActivities(*athleteID, accessToken, start)
+}
+
+func runRecordsCommand(args []string) error {
+	flags := newFlagSet("records")
+	athleteID := flags.Int("athlete", 0, "athlete id")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag("athlete", *athleteID); err != nil {
+		return err
+	}
+
+	records, err := currentRecords(*athleteID)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		fmt.Printf("%s %s: %s on %s (activity: %d)\n", r.Discipline, r.Effort, formatClock(r.ElapsedTime), r.AchievedAt.Format("2006-01-02"), r.ActivityID)
+	}
+	return nil
+}
+
+func runAPIKeyCommand(args []string) error {
+	flags := newFlagSet("apikey")
+	athleteID := flags.Int("athlete", 0, "athlete id")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag("athlete", *athleteID); err != nil {
+		return err
+	}
+
+	fmt.Println(athleteAPIKey(*athleteID))
+	return nil
+}
+
+func runUndoCommand(args []string) error {
+	flags := newFlagSet("undo")
+	changeID := flags.Int("change", 0, "change id, as listed by history")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag("change", *changeID); err != nil {
+		return err
+	}
+
+	// The change is undone with the token of the athlete owning the activity
+	change, err := getActivityChange(*changeID)
+	if err != nil {
+		return err
+	}
+	accessToken, err := getAccessTokenForAthlete(change.AthleteID)
+	if err != nil {
+		return err
+	}
+	change, err = undoActivityChange(*changeID, accessToken)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Workout %d restored to %q\n", change.ActivityID, change.PreviousName)
+	return nil
+}
+
+func runSubscriptionsCommand(args []string) error {
+	if len(args) == 0 {
+		return usageError("subscriptions")
+	}
+
+	flags := newFlagSet("subscriptions")
+	subscriptionID := flags.Int("id", 0, "subscription id")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		subscriptions, err := listPushSubscriptions()
+		if err != nil {
+			return err
+		}
+		for _, s := range subscriptions {
+			fmt.Printf("#%d %s (created %s)\n", s.ID, s.CallbackURL, s.CreatedAt.Format("2006-01-02 15:04"))
+		}
+		return nil
+	case "create":
+		subscription, err := createPushSubscription(webhookCallbackURL())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Subscription %d created for %s\n", subscription.ID, subscription.CallbackURL)
+		return nil
+	case "delete":
+		if err := requireFlag("id", *subscriptionID); err != nil {
+			return err
+		}
+		err := deletePushSubscription(*subscriptionID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Subscription %d deleted\n", *subscriptionID)
+		return nil
+	case "verify":
+		err := verifyWebhookCallback(webhookCallbackURL())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Callback %s is reachable\n", webhookCallbackURL())
+		return nil
+	}
+	return usageError("subscriptions")
+}
+
+func runScheduleCommand(args []string) error {
+	flags := newFlagSet("schedule")
+	athleteID := flags.Int("athlete", 0, "athlete id")
+	weekday := flags.Int("weekday", int(time.Sunday), "day of the weekly recap, 0 (Sunday) to 6 (Saturday)")
+	at := flags.String("at", "20:00", "time of the recaps, HH:MM")
+	timezone := flags.String("timezone", "UTC", "timezone of the athlete, e.g. Europe/Berlin")
+	weekStart := flags.Int("week-start", int(defaultWeekStart), "first day of the week, 0 (Sunday) to 6 (Saturday)")
+	periods := flags.String("periods", periodWeek, "recaps to generate, any of week, month, quarter and year")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag("athlete", *athleteID); err != nil {
+		return err
+	}
+
+	// Flags that weren't given keep the value of the existing schedule, a new schedule takes the defaults
+	schedule, err := getRecapSchedule(*athleteID)
+	isNew := err != nil
+	if isNew {
+		schedule = RecapSchedule{AthleteID: *athleteID}
+	}
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if set["weekday"] || isNew {
+		if *weekday < 0 || *weekday > 6 {
+			return fmt.Errorf("invalid weekday %d, expected 0 (Sunday) to 6 (Saturday)", *weekday)
+		}
+		schedule.Weekday = time.Weekday(*weekday)
+	}
+	if set["at"] || isNew {
+		t, err := time.Parse("15:04", *at)
+		if err != nil {
+			return fmt.Errorf("invalid time %q, expected HH:MM: %w", *at, err)
+		}
+		schedule.Hour, schedule.Minute = t.Hour(), t.Minute()
+	}
+	if set["timezone"] || isNew {
+		schedule.Timezone = *timezone
+	}
+	if set["week-start"] || isNew {
+		if *weekStart < 0 || *weekStart > 6 {
+			return fmt.Errorf("invalid week start %d, expected 0 (Sunday) to 6 (Saturday)", *weekStart)
+		}
+		schedule.WeekStart = time.Weekday(*weekStart)
+	}
+	if set["periods"] || isNew {
+		schedule.Periods = strings.Split(*periods, ",")
+	}
+
+	err = saveRecapSchedule(schedule)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Recaps (%s) of athlete %d scheduled on %s at %02d:%02d (%s), weeks start on %s\n",
+		strings.Join(schedule.Periods, ", "), schedule.AthleteID, schedule.Weekday, schedule.Hour, schedule.Minute, schedule.Timezone, schedule.WeekStart)
+	return nil
+}
+
+func runSettingsCommand(args []string) error {
+	flags := newFlagSet("settings")
+	athleteID := flags.Int("athlete", 0, "athlete id")
+	tone := flags.String("tone", "", "tone of the summaries, one of "+strings.Join(tones, ", "))
+	language := flags.String("language", "", "language of the summaries")
+	units := flags.String("units", "", "metric or imperial")
+	rename := flags.Bool("rename", true, "rename activities, otherwise only write their descriptions")
+	sports := flags.String("sports", "", "Strava sport types to process, all of them when empty")
+	plan := flags.String("plan", "", "weekly hours per discipline, e.g. swim=3,ride=6,run=4,strength=1")
+	skipCommutes := flags.Bool("skip-commutes", false, "leave commutes alone")
+	skipTrainer := flags.Bool("skip-trainer", false, "leave trainer activities alone")
+	skipPrivate := flags.Bool("skip-private", false, "leave private activities alone")
+	skipManual := flags.Bool("skip-manual", false, "leave manual entries alone")
+	minDistance := flags.Float64("min-distance", 0, "leave activities shorter than this many meters alone")
+	minDuration := flags.Duration("min-duration", 0, "leave activities shorter than this moving time alone, e.g. 10m")
+	excludeSports := flags.String("exclude-sports", "", "Strava sport types to leave alone")
+	excludeGear := flags.String("exclude-gear", "", "Strava gear ids to leave alone, e.g. b1234")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag("athlete", *athleteID); err != nil {
+		return err
+	}
+
+	settings, err := getAthleteSettings(*athleteID)
+	if err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if len(set) > 1 {
+		if set["tone"] {
+			settings.Tone = *tone
+		}
+		if set["language"] {
+			settings.Language = *language
+		}
+		if set["units"] {
+			settings.Units = *units
+		}
+		if set["rename"] {
+			settings.Rename = *rename
+		}
+		if set["sports"] {
+			settings.Sports = splitList(*sports)
+		}
+		if set["plan"] {
+			settings.Plan, err = parsePlan(*plan)
+			if err != nil {
+				return err
+			}
+		}
+		if set["skip-commutes"] {
+			settings.Filters.SkipCommutes = *skipCommutes
+		}
+		if set["skip-trainer"] {
+			settings.Filters.SkipTrainer = *skipTrainer
+		}
+		if set["skip-private"] {
+			settings.Filters.SkipPrivate = *skipPrivate
+		}
+		if set["skip-manual"] {
+			settings.Filters.SkipManual = *skipManual
+		}
+		if set["min-distance"] {
+			settings.Filters.MinDistance = *minDistance
+		}
+		if set["min-duration"] {
+			settings.Filters.MinDuration = int(minDuration.Seconds())
+		}
+		if set["exclude-sports"] {
+			settings.Filters.ExcludeSports = splitList(*excludeSports)
+		}
+		if set["exclude-gear"] {
+			settings.Filters.ExcludeGear = splitList(*excludeGear)
+		}
+		err = saveAthleteSettings(settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func runRecapsCommand(args []string) error {
+	flags := newFlagSet("recaps")
+	athleteID := flags.Int("athlete", 0, "athlete id")
+	period := flags.String("period", periodWeek, "week, month, quarter or year")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag("athlete", *athleteID); err != nil {
+		return err
+	}
+
+	if *period != periodWeek {
+		runs, err := listPeriodRecapRuns(*athleteID, *period)
+		if err != nil {
+			return err
+		}
+		for _, run := range runs {
+			fmt.Printf("%s of %s: %s\n", run.Period, run.PeriodStart, run.Status)
+		}
+		return nil
+	}
+
+	runs, err := listRecapRuns(*athleteID)
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		fmt.Printf("week of %s: %s (attempts: %d, activity: %d)\n", run.WeekStart, run.Status, run.Attempts, run.ActivityID)
+	}
+	return nil
+}
+
+func runRecapCommand(args []string) error {
+	flags := newFlagSet("recap")
+	athleteID := flags.Int("athlete", 0, "athlete id")
+	period := flags.String("period", periodMonth, "week, month, quarter, year or block")
+	date := flags.String("date", "", "any date in the period, YYYY-MM-DD, today by default")
+	from := flags.String("from", "", "first day of the training block, YYYY-MM-DD")
+	to := flags.String("to", "", "last day of the training block, YYYY-MM-DD")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag("athlete", *athleteID); err != nil {
+		return err
+	}
+	if !isRecapPeriod(*period) {
+		return fmt.Errorf("invalid period %q, expected week, month, quarter, year or block", *period)
+	}
+
+	accessToken, err := getAccessTokenForAthlete(*athleteID)
+	if err != nil {
+		return err
+	}
+	loc, weekStart := athleteCalendar(*athleteID, accessToken)
+	start, end, err := resolveRecapPeriod(*period, *date, *from, *to, loc, weekStart)
+	if err != nil {
+		return err
+	}
+	summary, err := generatePeriodRecap(*period, start, end, accessToken, settingsOrDefault(*athleteID))
+	if err != nil {
+		return err
+	}
+	fmt.Println(summary)
+	return nil
+}
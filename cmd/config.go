@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config is everything Stratonova can be configured with. It is loaded once at startup, from defaults, then an
+// optional JSON file, then environment variables, then command line flags, each overriding the one before.
+type Config struct {
+	Server   ServerConfig   `json:"server"`
+	Strava   StravaConfig   `json:"strava"`
+	Database DatabaseConfig `json:"database"`
+	LLM      LLMConfig      `json:"llm"`
+	Auth     AuthConfig     `json:"auth"`
+	Features FeatureConfig  `json:"features"`
+	Weather  WeatherConfig  `json:"weather"`
+}
+
+type ServerConfig struct {
+	Addr string `json:"addr"`
+	// PublicBaseURL is where Strava and browsers reach the server, used for the OAuth redirect and the webhook.
+	PublicBaseURL  string `json:"public_base_url"`
+	WebhookWorkers int    `json:"webhook_workers"`
+}
+
+type StravaConfig struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	VerifyToken  string `json:"verify_token"`
+}
+
+type DatabaseConfig struct {
+	User                   string `json:"user"`
+	Password               string `json:"password"`
+	Name                   string `json:"name"`
+	InstanceConnectionName string `json:"instance_connection_name"`
+	PrivateIP              bool   `json:"private_ip"`
+}
+
+type LLMConfig struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	APIKey   string `json:"api_key"`
+	BaseURL  string `json:"base_url"`
+	// PromptBudget is about how many tokens the activities of a prompt may take, past it activities are listed
+	// without their digest.
+	PromptBudget int `json:"prompt_budget"`
+}
+
+type AuthConfig struct {
+	// AdminAPIKey may act for every athlete and use the admin endpoints.
+	AdminAPIKey string `json:"admin_api_key"`
+	// SigningSecret signs the athletes' API keys.
+	SigningSecret string `json:"signing_secret"`
+}
+
+type WeatherConfig struct {
+	// Provider is open-meteo, fixtures, or empty to leave the weather out.
+	Provider string `json:"provider"`
+	// BaseURL is the Open-Meteo style forecast endpoint.
+	BaseURL string `json:"base_url"`
+	// ArchiveURL is the Open-Meteo style historical endpoint, for the activities older than the forecast goes back.
+	ArchiveURL string `json:"archive_url"`
+	// Fixtures is the directory the fixtures provider reads its responses from.
+	Fixtures string `json:"fixtures"`
+}
+
+// minSecretLength keeps the admin key and the signing secret out of reach of brute force.
+const minSecretLength = 32
+
+// FeatureConfig switches the background parts of the service on and off.
+type FeatureConfig struct {
+	WebhookWorkers bool `json:"webhook_workers"`
+	Scheduler      bool `json:"scheduler"`
+	// ClassifyNewRuns names new activities after the kind of training they were, it's off unless asked for.
+	ClassifyNewRuns bool `json:"classify_new_runs"`
+	// DebugToken serves the athletes' live Strava access tokens to the admin on /token.
+	DebugToken bool `json:"debug_token"`
+}
+
+const redactedValue = "[redacted]"
+
+// config is the configuration loaded at startup.
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			Addr:           ":8080",
+			PublicBaseURL:  "https://stratonova-l5snujqyaq-ew.a.run.app",
+			WebhookWorkers: defaultWebhookWorkers,
+		},
+		LLM: LLMConfig{
+			Provider:     "openai",
+			Model:        "gpt-4-1106-preview",
+			BaseURL:      "https://api.openai.com/v1",
+			PromptBudget: 3000,
+		},
+		Features: FeatureConfig{
+			WebhookWorkers: true,
+			Scheduler:      true,
+		},
+		// The weather is off unless asked for, the provider is told where the athletes train
+		Weather: WeatherConfig{
+			BaseURL:    "https://api.open-meteo.com/v1/forecast",
+			ArchiveURL: "https://archive-api.open-meteo.com/v1/archive",
+		},
+	}
+}
+
+// loadConfig parses the global flags in front of the command, and returns the configuration along with the
+// remaining arguments. The address to listen on is a flag of the serve command.
+func loadConfig(args []string) (Config, []string, error) {
+	cfg := defaultConfig()
+
+	flags := flag.NewFlagSet("stratonova", flag.ContinueOnError)
+	file := flags.String("config", os.Getenv("STRATONOVA_CONFIG"), "JSON configuration file")
+	publicURL := flags.String("public-url", "", "public base URL of the server")
+	model := flags.String("llm-model", "", "LLM model used for the summaries")
+	err := flags.Parse(args)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	if *file != "" {
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("failed to read the config file: %w", err)
+		}
+		err = json.Unmarshal(data, &cfg)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("failed to parse the config file %s: %w", *file, err)
+		}
+	}
+
+	err = applyEnv(&cfg)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	if *publicURL != "" {
+		cfg.Server.PublicBaseURL = *publicURL
+	}
+	if *model != "" {
+		cfg.LLM.Model = *model
+	}
+	cfg.Server.PublicBaseURL = strings.TrimSuffix(cfg.Server.PublicBaseURL, "/")
+
+	return cfg, flags.Args(), nil
+}
+
+// applyEnv overrides the configuration with the environment variables that are set.
+func applyEnv(cfg *Config) error {
+	texts := map[string]*string{
+		"SERVER_ADDR":              &cfg.Server.Addr,
+		"PUBLIC_BASE_URL":          &cfg.Server.PublicBaseURL,
+		"STRAVA_CLIENT_ID":         &cfg.Strava.ClientID,
+		"STRAVA_CLIENT_SECRET":     &cfg.Strava.ClientSecret,
+		"STRAVA_VERIFY_TOKEN":      &cfg.Strava.VerifyToken,
+		"DB_USER":                  &cfg.Database.User,
+		"DB_PASS":                  &cfg.Database.Password,
+		"DB_NAME":                  &cfg.Database.Name,
+		"INSTANCE_CONNECTION_NAME": &cfg.Database.InstanceConnectionName,
+		"LLM_PROVIDER":             &cfg.LLM.Provider,
+		"LLM_MODEL":                &cfg.LLM.Model,
+		"LLM_BASE_URL":             &cfg.LLM.BaseURL,
+		"OPENAI_API_KEY":           &cfg.LLM.APIKey,
+		"ADMIN_API_KEY":            &cfg.Auth.AdminAPIKey,
+		"SIGNING_SECRET":           &cfg.Auth.SigningSecret,
+		"WEATHER_BASE_URL":         &cfg.Weather.BaseURL,
+		"WEATHER_ARCHIVE_URL":      &cfg.Weather.ArchiveURL,
+		"WEATHER_FIXTURES":         &cfg.Weather.Fixtures,
+	}
+	for name, field := range texts {
+		if value := os.Getenv(name); value != "" {
+			*field = value
+		}
+	}
+
+	numbers := map[string]*int{
+		"WEBHOOK_WORKERS":   &cfg.Server.WebhookWorkers,
+		"LLM_PROMPT_BUDGET": &cfg.LLM.PromptBudget,
+	}
+	for name, field := range numbers {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got %q", name, value)
+		}
+		*field = number
+	}
+
+	// WEATHER_PROVIDER counts even when empty, it turns the weather off then
+	if value, ok := os.LookupEnv("WEATHER_PROVIDER"); ok {
+		cfg.Weather.Provider = value
+	}
+
+	// PRIVATE_IP connects to the database over its private IP whenever it is set
+	if os.Getenv("PRIVATE_IP") != "" {
+		cfg.Database.PrivateIP = true
+	}
+
+	bools := map[string]*bool{
+		"FEATURE_WEBHOOK_WORKERS":   &cfg.Features.WebhookWorkers,
+		"FEATURE_SCHEDULER":         &cfg.Features.Scheduler,
+		"FEATURE_CLASSIFY_NEW_RUNS": &cfg.Features.ClassifyNewRuns,
+		"FEATURE_DEBUG_TOKEN":       &cfg.Features.DebugToken,
+	}
+	for name, field := range bools {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false, got %q", name, value)
+		}
+		*field = enabled
+	}
+	return nil
+}
+
+// validate reports every missing or invalid setting at once.
+func (c Config) validate() error {
+	var problems []string
+	required := []struct {
+		value string
+		name  string
+	}{
+		{c.Server.Addr, "server.addr (SERVER_ADDR)"},
+		{c.Server.PublicBaseURL, "server.public_base_url (PUBLIC_BASE_URL)"},
+		{c.Strava.ClientID, "strava.client_id (STRAVA_CLIENT_ID)"},
+		{c.Strava.ClientSecret, "strava.client_secret (STRAVA_CLIENT_SECRET)"},
+		{c.Strava.VerifyToken, "strava.verify_token (STRAVA_VERIFY_TOKEN)"},
+		{c.Database.User, "database.user (DB_USER)"},
+		{c.Database.Password, "database.password (DB_PASS)"},
+		{c.Database.Name, "database.name (DB_NAME)"},
+		{c.Database.InstanceConnectionName, "database.instance_connection_name (INSTANCE_CONNECTION_NAME)"},
+		{c.LLM.Model, "llm.model (LLM_MODEL)"},
+		{c.LLM.APIKey, "llm.api_key (OPENAI_API_KEY)"},
+		{c.LLM.BaseURL, "llm.base_url (LLM_BASE_URL)"},
+	}
+	for _, r := range required {
+		if r.value == "" {
+			problems = append(problems, fmt.Sprintf("%s is not set", r.name))
+		}
+	}
+
+	if !strings.HasPrefix(c.Server.PublicBaseURL, "https://") && !strings.HasPrefix(c.Server.PublicBaseURL, "http://") {
+		problems = append(problems, fmt.Sprintf("server.public_base_url must be an http(s) URL, got %q", c.Server.PublicBaseURL))
+	}
+	for _, secret := range []struct {
+		value string
+		name  string
+	}{
+		{c.Auth.AdminAPIKey, "auth.admin_api_key (ADMIN_API_KEY)"},
+		{c.Auth.SigningSecret, "auth.signing_secret (SIGNING_SECRET)"},
+	} {
+		if len(secret.value) < minSecretLength {
+			problems = append(problems, fmt.Sprintf("%s must be at least %d characters long", secret.name, minSecretLength))
+		}
+	}
+	if c.Server.WebhookWorkers < 1 {
+		problems = append(problems, fmt.Sprintf("server.webhook_workers must be at least 1, got %d", c.Server.WebhookWorkers))
+	}
+	if c.LLM.PromptBudget < 500 {
+		problems = append(problems, fmt.Sprintf("llm.prompt_budget must be at least 500 tokens, got %d", c.LLM.PromptBudget))
+	}
+	if c.LLM.Provider != "openai" {
+		problems = append(problems, fmt.Sprintf("llm.provider %q is not supported, only openai is", c.LLM.Provider))
+	}
+	switch c.Weather.Provider {
+	case "":
+	case weatherProviderOpenMeteo:
+		if !strings.HasPrefix(c.Weather.BaseURL, "https://") && !strings.HasPrefix(c.Weather.BaseURL, "http://") {
+			problems = append(problems, fmt.Sprintf("weather.base_url must be an http(s) URL, got %q", c.Weather.BaseURL))
+		}
+		if !strings.HasPrefix(c.Weather.ArchiveURL, "https://") && !strings.HasPrefix(c.Weather.ArchiveURL, "http://") {
+			problems = append(problems, fmt.Sprintf("weather.archive_url must be an http(s) URL, got %q", c.Weather.ArchiveURL))
+		}
+	case weatherProviderFixtures:
+		if c.Weather.Fixtures == "" {
+			problems = append(problems, "weather.fixtures (WEATHER_FIXTURES) is not set")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("weather.provider %q is not supported, expected open-meteo, fixtures or nothing", c.Weather.Provider))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// redacted returns a copy of the configuration that is safe to print.
+func (c Config) redacted() Config {
+	for _, secret := range []*string{&c.Strava.ClientSecret, &c.Strava.VerifyToken, &c.Database.Password, &c.LLM.APIKey, &c.Auth.AdminAPIKey, &c.Auth.SigningSecret} {
+		if *secret != "" {
+			*secret = redactedValue
+		}
+	}
+	return c
+}
+
+func runConfigCommand(args []string) error {
+	flags := newFlagSet("config")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(config.redacted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return config.validate()
+}
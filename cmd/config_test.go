@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestApplyEnvWeatherProvider(t *testing.T) {
+	tests := []struct {
+		name     string
+		fromFile string
+		env      *string
+		want     string
+	}{
+		{name: "off by default", want: ""},
+		{name: "file", fromFile: weatherProviderOpenMeteo, want: weatherProviderOpenMeteo},
+		{name: "environment", env: stringPointer(weatherProviderFixtures), want: weatherProviderFixtures},
+		{name: "environment over file", fromFile: weatherProviderOpenMeteo, env: stringPointer(weatherProviderFixtures), want: weatherProviderFixtures},
+		{name: "empty environment turns it off", fromFile: weatherProviderOpenMeteo, env: stringPointer(""), want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != nil {
+				t.Setenv("WEATHER_PROVIDER", *tt.env)
+			} else if value, ok := os.LookupEnv("WEATHER_PROVIDER"); ok {
+				// t.Setenv restores the variable once the test is over, it's unset in between
+				t.Setenv("WEATHER_PROVIDER", value)
+				os.Unsetenv("WEATHER_PROVIDER")
+			}
+
+			cfg := defaultConfig()
+			if tt.fromFile != "" {
+				cfg.Weather.Provider = tt.fromFile
+			}
+			err := applyEnv(&cfg)
+			if err != nil {
+				t.Fatalf("applyEnv() failed: %s", err)
+			}
+			if cfg.Weather.Provider != tt.want {
+				t.Errorf("weather provider = %q, want %q", cfg.Weather.Provider, tt.want)
+			}
+		})
+	}
+}
+
+func stringPointer(s string) *string {
+	return &s
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	// charsPerToken is a rough count of the characters an LLM token stands for, to keep prompts within budget.
+	charsPerToken = 4
+	// repEffortRatio is how much harder than the average lap a lap must go to count as an interval rep.
+	repEffortRatio = 1.1
+	// recapDetailsBudgetShare is the share of Strava's rate limits the weekly recaps may use to fetch the laps and
+	// splits of the week's activities.
+	recapDetailsBudgetShare = 0.8
+)
+
+// Split is a kilometer or a mile of an activity, as Strava splits it.
+type Split struct {
+	Distance     float64 `json:"distance"`
+	MovingTime   int     `json:"moving_time"`
+	AverageSpeed float64 `json:"average_speed"`
+}
+
+// writeActivityLines lists the workouts in a prompt. Every workout gets its full digest as long as the prompt budget
+// allows, the ones that don't fit get the short line, so no workout is left out.
+func writeActivityLines(sb *strings.Builder, workouts []Workout, loc Locale) {
+	budget := config.LLM.PromptBudget * charsPerToken
+
+	lines := make([]string, len(workouts))
+	digests := make([]string, len(workouts))
+	used := 0
+	for i, w := range workouts {
+		lines[i] = activityLine(w, loc, false)
+		digests[i] = activityLine(w, loc, true)
+		used += len(lines[i])
+	}
+	for i := range workouts {
+		if extra := len(digests[i]) - len(lines[i]); used+extra <= budget {
+			lines[i] = digests[i]
+			used += extra
+		}
+	}
+	for _, line := range lines {
+		sb.WriteString(line)
+	}
+}
+
+// activityLine is an activity as the prompts list it, without its hashtags but with what they said. The detailed
+// line adds the activity's digest.
+func activityLine(w Workout, loc Locale, detailed bool) string {
+	tags, w := readHashtags(w)
+	summary := describeWorkout(w, loc)
+	if detailed {
+		summary = activityDigest(w, loc)
+	}
+	line := fmt.Sprintf("- %s (%s, %s): %s.", w.Name, w.SportType, loc.date(localStartDate(w), "Monday"), summary)
+	for _, text := range []string{w.Description, tags.notes()} {
+		if text != "" {
+			line += " " + text
+		}
+	}
+	return line + "\n"
+}
+
+// activityDigest packs what the LLM needs to comment on an activity into a few words: distance, time and pace, heart
+// rate, climbing, how the pace evolved over the splits and the interval reps, e.g. "10.00 km in 50m at 5:00 /km,
+// HR 152 avg 171 max, +120 m (12 m/km), negative split 5:10 → 4:50 /km, 6×800m @ 3:35 /km".
+func activityDigest(w Workout, loc Locale) string {
+	parts := []string{describeWorkout(w, loc)}
+	if discipline(w.SportType) == disciplineStrength || w.Distance == 0 {
+		return parts[0]
+	}
+
+	if w.HeartRate > 0 {
+		hr := fmt.Sprintf("HR %.0f avg", w.HeartRate)
+		if w.MaxHeartRate > 0 {
+			hr += fmt.Sprintf(" %.0f max", w.MaxHeartRate)
+		}
+		parts = append(parts, hr)
+	}
+	if w.TotalElevationGain > 0 && discipline(w.SportType) != disciplineSwim {
+		parts = append(parts, fmt.Sprintf("+%s (%s)", loc.elevation(w.TotalElevationGain), loc.climbRate(w.TotalElevationGain, w.Distance)))
+	}
+	if trend := splitTrend(w, loc); trend != "" {
+		parts = append(parts, trend)
+	}
+	if reps := intervalReps(w, loc); reps != "" {
+		parts = append(parts, reps)
+	}
+	if weather := weatherDigest(w, loc); weather != "" {
+		parts = append(parts, weather)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// splitTrend compares the pace of the first and second half of the splits: a negative split when the second half went
+// faster.
+func splitTrend(w Workout, loc Locale) string {
+	if discipline(w.SportType) != disciplineRun {
+		return ""
+	}
+	splits := w.SplitsMetric
+	if loc.Units == unitsImperial {
+		splits = w.SplitsStandard
+	}
+	// A short last split says little about the pace
+	if n := len(splits); n > 0 && splits[n-1].Distance < 500 {
+		splits = splits[:n-1]
+	}
+	if len(splits) < 4 {
+		return ""
+	}
+
+	half := len(splits) / 2
+	first, second := averageSplitSpeed(splits[:half]), averageSplitSpeed(splits[half:])
+	if first <= 0 || second <= 0 {
+		return ""
+	}
+	change := (second - first) / first
+	switch {
+	case change > 0.02:
+		return fmt.Sprintf("negative split %s → %s", loc.pace(first), loc.pace(second))
+	case change < -0.02:
+		return fmt.Sprintf("positive split %s → %s", loc.pace(first), loc.pace(second))
+	}
+	return "even splits"
+}
+
+func averageSplitSpeed(splits []Split) float64 {
+	distance, seconds := 0.0, 0
+	for _, s := range splits {
+		distance += s.Distance
+		seconds += s.MovingTime
+	}
+	if seconds == 0 {
+		return 0
+	}
+	return distance / float64(seconds)
+}
+
+// intervalReps describes the hard laps of a structured workout, "6×800m @ 3:35 /km" for runs and swims, "5×5min @
+// 280 W" for rides. It returns nothing when the laps don't look like intervals.
+func intervalReps(w Workout, loc Locale) string {
+	if len(w.Laps) < 4 || countEffortJumps(w.Laps, repEffortRatio-1) < 3 {
+		return ""
+	}
+	// The average rather than the median, reps can be half of the laps
+	total := 0.0
+	for _, lap := range w.Laps {
+		total += lapEffort(lap)
+	}
+	threshold := total / float64(len(w.Laps)) * repEffortRatio
+
+	var reps []Lap
+	for _, lap := range w.Laps {
+		if lapEffort(lap) > threshold {
+			reps = append(reps, lap)
+		}
+	}
+	if len(reps) < 2 {
+		return ""
+	}
+
+	distance, seconds, watts := 0.0, 0, 0.0
+	lengths := make([]float64, len(reps))
+	for i, lap := range reps {
+		distance += lap.Distance
+		seconds += lap.MovingTime
+		watts += lap.AverageWatts
+		lengths[i] = lap.Distance
+		if discipline(w.SportType) == disciplineRide {
+			lengths[i] = float64(lap.MovingTime)
+		}
+	}
+
+	length := formatRepDistance(median(lengths), loc)
+	if discipline(w.SportType) == disciplineRide {
+		length = formatRepDuration(median(lengths))
+	}
+	if !similar(lengths, 0.1) {
+		length = "~" + length
+	}
+
+	var intensity string
+	switch {
+	case discipline(w.SportType) == disciplineRide && watts > 0:
+		intensity = fmt.Sprintf("%.0f W", watts/float64(len(reps)))
+	case discipline(w.SportType) == disciplineRide:
+		intensity = loc.speed(distance / float64(seconds))
+	case discipline(w.SportType) == disciplineSwim:
+		intensity = loc.swimPace(distance / float64(seconds))
+	default:
+		intensity = loc.pace(distance / float64(seconds))
+	}
+	return fmt.Sprintf("%d×%s @ %s", len(reps), length, intensity)
+}
+
+// formatRepDistance formats the length of a rep the way track sessions are written, "400m" or "2km". Athletes using
+// miles count reps of a mile and more in miles.
+func formatRepDistance(meters float64, loc Locale) string {
+	switch {
+	case loc.Units == unitsImperial && meters >= metersPerMile*0.95:
+		return formatRepLength(meters/metersPerMile, loc) + "mi"
+	case meters >= 1000:
+		return formatRepLength(meters/1000, loc) + "km"
+	}
+	return fmt.Sprintf("%.0fm", math.Round(meters/50)*50)
+}
+
+// formatRepLength writes whole lengths without decimals, "2km" rather than "2.0km".
+func formatRepLength(length float64, loc Locale) string {
+	rounded := math.Round(length*10) / 10
+	if rounded == math.Trunc(rounded) {
+		return loc.number(rounded, 0)
+	}
+	return loc.number(rounded, 1)
+}
+
+func formatRepDuration(seconds float64) string {
+	rounded := int(math.Round(seconds/15) * 15)
+	switch {
+	case rounded < 60:
+		return fmt.Sprintf("%ds", rounded)
+	case rounded%60 == 0:
+		return fmt.Sprintf("%dmin", rounded/60)
+	}
+	return fmt.Sprintf("%d:%02dmin", rounded/60, rounded%60)
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return sorted[len(sorted)/2]
+}
+
+// similar tells whether all values are within the given ratio of their median.
+func similar(values []float64, ratio float64) bool {
+	m := median(values)
+	for _, v := range values {
+		if math.Abs(v-m) > m*ratio {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchWorkoutDetails replaces the workouts listed by Strava with the detailed ones, which come with laps and splits,
+// from the store or from Strava. A workout whose details can't be fetched keeps its summary.
+func fetchWorkoutDetails(workouts []Workout, accessToken string) []Workout {
+	detailed := make([]Workout, len(workouts))
+	for i, w := range workouts {
+		workout, err := detailedActivity(w.ID, accessToken, recapDetailsBudgetShare)
+		if err != nil {
+			fmt.Printf("Failed to fetch the details of activity %d, using its summary: %s\n", w.ID, err)
+			workout = w
+		}
+		detailed[i] = workout
+	}
+	return detailed
+}
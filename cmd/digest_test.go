@@ -0,0 +1,121 @@
+package main
+
+import "testing"
+
+// runLap is a lap covered at a steady speed.
+func runLap(meters float64, seconds int) Lap {
+	return Lap{Distance: meters, MovingTime: seconds, AverageSpeed: meters / float64(seconds)}
+}
+
+func rideLap(seconds int, watts float64) Lap {
+	return Lap{Distance: float64(seconds) * 9, MovingTime: seconds, AverageSpeed: 9, AverageWatts: watts}
+}
+
+func kilometerSplits(seconds ...int) []Split {
+	splits := make([]Split, len(seconds))
+	for i, s := range seconds {
+		splits[i] = Split{Distance: 1000, MovingTime: s, AverageSpeed: 1000 / float64(s)}
+	}
+	return splits
+}
+
+func TestIntervalReps(t *testing.T) {
+	metric := AthleteSettings{Units: unitsMetric}.locale()
+	imperial := AthleteSettings{Units: unitsImperial}.locale()
+
+	var trackSession []Lap
+	trackSession = append(trackSession, runLap(2000, 667))
+	for i := 0; i < 6; i++ {
+		trackSession = append(trackSession, runLap(800, 215), runLap(400, 160))
+	}
+	trackSession = append(trackSession, runLap(1500, 517))
+
+	var sweetSpot []Lap
+	sweetSpot = append(sweetSpot, rideLap(600, 150))
+	for i := 0; i < 5; i++ {
+		sweetSpot = append(sweetSpot, rideLap(300, 280), rideLap(180, 140))
+	}
+	sweetSpot = append(sweetSpot, rideLap(600, 130))
+
+	var mileRepeats []Lap
+	mileRepeats = append(mileRepeats, runLap(metersPerMile, 536))
+	for i := 0; i < 4; i++ {
+		mileRepeats = append(mileRepeats, runLap(metersPerMile, 402))
+		if i < 3 {
+			mileRepeats = append(mileRepeats, runLap(400, 160))
+		}
+	}
+	mileRepeats = append(mileRepeats, runLap(metersPerMile, 536))
+
+	pyramid := []Lap{
+		runLap(1000, 333),
+		runLap(400, 105), runLap(400, 160),
+		runLap(800, 211), runLap(400, 160),
+		runLap(1200, 316),
+		runLap(1000, 333),
+	}
+
+	steady := make([]Lap, 10)
+	for i := range steady {
+		steady[i] = runLap(1000, 300)
+	}
+
+	tests := []struct {
+		name    string
+		workout Workout
+		loc     Locale
+		want    string
+	}{
+		{"track session", Workout{SportType: "Run", Laps: trackSession}, metric, "6×800m @ 4:29 /km"},
+		{"sweet spot ride", Workout{SportType: "Ride", Laps: sweetSpot}, metric, "5×5min @ 280 W"},
+		{"mile repeats", Workout{SportType: "Run", Laps: mileRepeats}, imperial, "4×1mi @ 6:42 /mi"},
+		{"reps of different lengths", Workout{SportType: "Run", Laps: pyramid}, metric, "3×~800m @ 4:23 /km"},
+		{"steady run", Workout{SportType: "Run", Laps: steady}, metric, ""},
+		{"too few laps", Workout{SportType: "Run", Laps: trackSession[:3]}, metric, ""},
+		{"no laps", Workout{SportType: "Run"}, metric, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := intervalReps(tt.workout, tt.loc); got != tt.want {
+				t.Errorf("intervalReps() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitTrend(t *testing.T) {
+	metric := AthleteSettings{Units: unitsMetric}.locale()
+	imperial := AthleteSettings{Units: unitsImperial}.locale()
+
+	miles := []Split{
+		{Distance: metersPerMile, MovingTime: 480},
+		{Distance: metersPerMile, MovingTime: 480},
+		{Distance: metersPerMile, MovingTime: 470},
+		{Distance: metersPerMile, MovingTime: 470},
+	}
+	fastFinish := append(kilometerSplits(300, 300, 300, 300), Split{Distance: 200, MovingTime: 30})
+
+	tests := []struct {
+		name    string
+		workout Workout
+		loc     Locale
+		want    string
+	}{
+		{"negative split", Workout{SportType: "Run", SplitsMetric: kilometerSplits(300, 300, 300, 285, 285, 285)}, metric, "negative split 5:00 /km → 4:45 /km"},
+		{"positive split", Workout{SportType: "TrailRun", SplitsMetric: kilometerSplits(285, 285, 285, 300, 300, 300)}, metric, "positive split 4:45 /km → 5:00 /km"},
+		{"even splits", Workout{SportType: "Run", SplitsMetric: kilometerSplits(300, 300, 300, 300)}, metric, "even splits"},
+		{"within 2%", Workout{SportType: "Run", SplitsMetric: kilometerSplits(300, 300, 297, 297)}, metric, "even splits"},
+		{"short last split left out", Workout{SportType: "Run", SplitsMetric: fastFinish}, metric, "even splits"},
+		{"miles", Workout{SportType: "Run", SplitsMetric: kilometerSplits(300, 300, 300, 300, 300, 300), SplitsStandard: miles}, imperial, "negative split 8:00 /mi → 7:50 /mi"},
+		{"too few splits", Workout{SportType: "Run", SplitsMetric: kilometerSplits(300, 280, 260)}, metric, ""},
+		{"without moving time", Workout{SportType: "Run", SplitsMetric: []Split{{Distance: 1000}, {Distance: 1000}, {Distance: 1000}, {Distance: 1000}}}, metric, ""},
+		{"not a run", Workout{SportType: "Ride", SplitsMetric: kilometerSplits(300, 300, 300, 285, 285, 285)}, metric, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitTrend(tt.workout, tt.loc); got != tt.want {
+				t.Errorf("splitTrend() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	// similarDistanceRatio is how far from a run's distance a past run may be to compare with it, 10 km runs are
+	// compared with runs from 7.5 to 12.5 km.
+	similarDistanceRatio = 0.25
+	// similarPaceRatio is how far from a run's pace a past run may be to compare their heart rates.
+	similarPaceRatio = 0.03
+	// minSimilarRuns is how many similar runs make a history worth comparing with.
+	minSimilarRuns = 5
+)
+
+// historyWindow is how far back runs are compared, the athlete of two years ago is another runner.
+var historyWindow = 365 * 24 * time.Hour
+
+// EffortComparison scores a run against the athlete's own runs of the same sport type and a similar distance.
+type EffortComparison struct {
+	SimilarRuns int
+	// PacePercentile is the share of the similar runs that were slower, from 0 to 100.
+	PacePercentile float64
+	// HeartRateDelta is how many bpm higher the heart rate was than in past runs at the same pace, only meaningful
+	// when HeartRateRuns is at least minSimilarRuns.
+	HeartRateDelta float64
+	HeartRateRuns  int
+	// RelativeEffort is the run's relative effort per hour against the median of the similar runs, 1.2 is 20% harder
+	// than usual, 0 when Strava didn't score the runs.
+	RelativeEffort float64
+}
+
+// compareEffort scores the run against the runs of the history done in the year before it. It returns false when
+// there are too few similar runs to tell.
+func compareEffort(run Workout, history []Workout) (EffortComparison, bool) {
+	var comparison EffortComparison
+	if discipline(run.SportType) != disciplineRun || run.AverageSpeed <= 0 {
+		return comparison, false
+	}
+
+	var slower int
+	var heartRates, efforts []float64
+	for _, past := range history {
+		if past.ID == run.ID || past.SportType != run.SportType || !past.Date.Before(run.Date) || run.Date.Sub(past.Date) > historyWindow {
+			continue
+		}
+		// Heart rates compare at the same pace, whatever the distance
+		if past.HeartRate > 0 && math.Abs(past.AverageSpeed-run.AverageSpeed) <= run.AverageSpeed*similarPaceRatio {
+			heartRates = append(heartRates, past.HeartRate)
+		}
+		if math.Abs(past.Distance-run.Distance) > run.Distance*similarDistanceRatio {
+			continue
+		}
+		comparison.SimilarRuns++
+		if past.AverageSpeed < run.AverageSpeed {
+			slower++
+		}
+		if past.SufferScore > 0 && past.Duration > 0 {
+			efforts = append(efforts, past.SufferScore/float64(past.Duration))
+		}
+	}
+	if comparison.SimilarRuns < minSimilarRuns {
+		return comparison, false
+	}
+
+	comparison.PacePercentile = float64(slower) / float64(comparison.SimilarRuns) * 100
+	if run.HeartRate > 0 && len(heartRates) >= minSimilarRuns {
+		comparison.HeartRateRuns = len(heartRates)
+		comparison.HeartRateDelta = run.HeartRate - median(heartRates)
+	}
+	if run.SufferScore > 0 && run.Duration > 0 && len(efforts) >= minSimilarRuns {
+		comparison.RelativeEffort = run.SufferScore / float64(run.Duration) / median(efforts)
+	}
+	return comparison, true
+}
+
+// compareWithHistory scores each run among the workouts against the athlete's stored activities. Runs without enough
+// similar runs in the store are left out.
+func compareWithHistory(workouts []Workout) (map[int]EffortComparison, error) {
+	comparisons := map[int]EffortComparison{}
+	if len(workouts) == 0 {
+		return comparisons, nil
+	}
+
+	from, to := workouts[0].Date, workouts[0].Date
+	for _, w := range workouts {
+		if w.Date.Before(from) {
+			from = w.Date
+		}
+		if w.Date.After(to) {
+			to = w.Date
+		}
+	}
+	history, err := listStoredActivities(workouts[0].Athlete.ID, from.Add(-historyWindow), to)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, w := range workouts {
+		if comparison, ok := compareEffort(w, history); ok {
+			comparisons[w.ID] = comparison
+		}
+	}
+	return comparisons, nil
+}
+
+// weekComparisons returns the comparisons of the week's runs for its summary, none when the history can't be read,
+// a summary is still worth posting without them.
+func weekComparisons(workouts []Workout) map[int]EffortComparison {
+	comparisons, err := compareWithHistory(workouts)
+	if err != nil {
+		fmt.Printf("Failed to compare the runs with their history: %s\n", err)
+		return nil
+	}
+	return comparisons
+}
+
+// describe tells the coach how the run compares, e.g. "faster than 80% of my 12 similar runs of the past year,
+// heart rate 4 bpm lower than usual at this pace, relative effort 15% above usual".
+func (c EffortComparison) describe() string {
+	parts := []string{fmt.Sprintf("faster than %.0f%% of my %d similar runs of the past year", c.PacePercentile, c.SimilarRuns)}
+	if c.HeartRateRuns > 0 {
+		switch delta := math.Round(c.HeartRateDelta); {
+		case delta >= 1:
+			parts = append(parts, fmt.Sprintf("heart rate %.0f bpm higher than usual at this pace", delta))
+		case delta <= -1:
+			parts = append(parts, fmt.Sprintf("heart rate %.0f bpm lower than usual at this pace", -delta))
+		default:
+			parts = append(parts, "heart rate as usual at this pace")
+		}
+	}
+	if c.RelativeEffort > 0 {
+		switch change := math.Round((c.RelativeEffort - 1) * 100); {
+		case change >= 1:
+			parts = append(parts, fmt.Sprintf("relative effort %.0f%% above usual", change))
+		case change <= -1:
+			parts = append(parts, fmt.Sprintf("relative effort %.0f%% below usual", -change))
+		default:
+			parts = append(parts, "relative effort as usual")
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// writeEffortComparisons tells the coach how hard the runs of the week were for the athlete, compared with their own
+// history.
+func writeEffortComparisons(sb *strings.Builder, workouts []Workout, comparisons map[int]EffortComparison, loc Locale) {
+	if len(comparisons) == 0 {
+		return
+	}
+	sb.WriteString("\nHow my runs compare with my history at a similar distance:\n")
+	for _, w := range workouts {
+		if c, ok := comparisons[w.ID]; ok {
+			_, w = readHashtags(w)
+			sb.WriteString(fmt.Sprintf("- %s (%s): %s\n", w.Name, loc.date(localStartDate(w), "Monday"), c.describe()))
+		}
+	}
+	sb.WriteString("Tell me how much effort the runs were for me compared with my history.\n")
+}
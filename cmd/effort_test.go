@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var effortRunDate = time.Date(2024, 6, 1, 7, 0, 0, 0, time.UTC)
+
+// pastRun is a run of the history, the given days before the compared run.
+func pastRun(id int, daysBefore int, distance float64, speed float64) Workout {
+	return Workout{
+		ID:           id,
+		SportType:    "Run",
+		Distance:     distance,
+		AverageSpeed: speed,
+		Duration:     int(distance / speed),
+		Date:         effortRunDate.AddDate(0, 0, -daysBefore),
+	}
+}
+
+func TestCompareEffort(t *testing.T) {
+	run := Workout{ID: 100, SportType: "Run", Distance: 10000, AverageSpeed: 3.5, Duration: 3000, HeartRate: 150, SufferScore: 60, Date: effortRunDate}
+
+	slowerRuns := func(n int) []Workout {
+		var runs []Workout
+		for i := 0; i < n; i++ {
+			runs = append(runs, pastRun(i+1, 7*(i+1), 10000, 3.0))
+		}
+		return runs
+	}
+
+	var pacedRuns []Workout
+	for i, speed := range []float64{3.0, 3.1, 3.2, 3.3, 3.4, 3.45, 3.6, 3.7} {
+		pacedRuns = append(pacedRuns, pastRun(i+1, 10*(i+1), 9000+float64(i)*300, speed))
+	}
+
+	ignored := append(slowerRuns(5),
+		Workout{ID: run.ID, SportType: "Run", Distance: 10000, AverageSpeed: 3.0, Date: effortRunDate},
+		Workout{ID: 50, SportType: "TrailRun", Distance: 10000, AverageSpeed: 3.0, Date: effortRunDate.AddDate(0, 0, -3)},
+		pastRun(51, -2, 10000, 3.0),
+		pastRun(52, 400, 10000, 3.0),
+		pastRun(53, 20, 20000, 3.0),
+		pastRun(54, 21, 7000, 3.0),
+	)
+
+	heartRates := slowerRuns(5)
+	for i, hr := range []float64{154, 156, 158, 160, 162} {
+		sameEffort := pastRun(60+i, 3*(i+1), 5000, 3.5)
+		sameEffort.HeartRate = hr
+		heartRates = append(heartRates, sameEffort)
+	}
+
+	efforts := slowerRuns(5)
+	for i := range efforts {
+		efforts[i].Duration = 3000
+		efforts[i].SufferScore = 50
+	}
+
+	tests := []struct {
+		name    string
+		run     Workout
+		history []Workout
+		want    EffortComparison
+		wantOK  bool
+	}{
+		{
+			name:    "pace percentile",
+			run:     run,
+			history: pacedRuns,
+			want:    EffortComparison{SimilarRuns: 8, PacePercentile: 75},
+			wantOK:  true,
+		},
+		{
+			name:    "runs that don't compare are left out",
+			run:     run,
+			history: ignored,
+			want:    EffortComparison{SimilarRuns: 5, PacePercentile: 100},
+			wantOK:  true,
+		},
+		{
+			name:    "heart rate at the same pace, whatever the distance",
+			run:     run,
+			history: heartRates,
+			want:    EffortComparison{SimilarRuns: 5, PacePercentile: 100, HeartRateDelta: -8, HeartRateRuns: 5},
+			wantOK:  true,
+		},
+		{
+			name:    "relative effort",
+			run:     run,
+			history: efforts,
+			want:    EffortComparison{SimilarRuns: 5, PacePercentile: 100, RelativeEffort: 1.2},
+			wantOK:  true,
+		},
+		{
+			name:    "too few similar runs",
+			run:     run,
+			history: slowerRuns(minSimilarRuns - 1),
+			want:    EffortComparison{SimilarRuns: minSimilarRuns - 1},
+			wantOK:  false,
+		},
+		{
+			name:    "not a run",
+			run:     Workout{ID: 101, SportType: "Ride", Distance: 40000, AverageSpeed: 8, Date: effortRunDate},
+			history: slowerRuns(10),
+			wantOK:  false,
+		},
+		{
+			name:    "without a speed",
+			run:     Workout{ID: 102, SportType: "Run", Distance: 10000, Date: effortRunDate},
+			history: slowerRuns(10),
+			wantOK:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := compareEffort(tt.run, tt.history)
+			if ok != tt.wantOK {
+				t.Fatalf("compareEffort() ok = %t, want %t", ok, tt.wantOK)
+			}
+			if got.SimilarRuns != tt.want.SimilarRuns || got.HeartRateRuns != tt.want.HeartRateRuns ||
+				math.Abs(got.PacePercentile-tt.want.PacePercentile) > 1e-9 ||
+				math.Abs(got.HeartRateDelta-tt.want.HeartRateDelta) > 1e-9 ||
+				math.Abs(got.RelativeEffort-tt.want.RelativeEffort) > 1e-9 {
+				t.Errorf("compareEffort() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
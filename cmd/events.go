@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Strava webhook object and aspect types, see https://developers.strava.com/docs/webhooks/
+const (
+	objectTypeActivity = "activity"
+	objectTypeAthlete  = "athlete"
+
+	aspectTypeCreate = "create"
+	aspectTypeUpdate = "update"
+	aspectTypeDelete = "delete"
+)
+
+const sourceAthlete = "athlete"
+
+// isWebhookEventHandled decides, while Strava is waiting for the acknowledgement, whether an event is worth queueing.
+func isWebhookEventHandled(event WebhookEvent) bool {
+	switch event.ObjectType {
+	case objectTypeActivity:
+		switch event.AspectType {
+		case aspectTypeCreate, aspectTypeUpdate, aspectTypeDelete:
+			return true
+		}
+	case objectTypeAthlete:
+		return isDeauthorization(event)
+	}
+	return false
+}
+
+// isDeauthorization reports whether the athlete revoked Stratonova's access to their account.
+func isDeauthorization(event WebhookEvent) bool {
+	return event.ObjectType == objectTypeAthlete && event.AspectType == aspectTypeUpdate && event.Updates["authorized"] == "false"
+}
+
+// processWebhookEvent runs the work for a queued webhook event.
+func processWebhookEvent(event WebhookEvent) error {
+	switch {
+	case event.ObjectType == objectTypeActivity && event.AspectType == aspectTypeCreate:
+		return processActivityCreate(event)
+	case event.ObjectType == objectTypeActivity && event.AspectType == aspectTypeUpdate:
+		return processActivityUpdate(event)
+	case event.ObjectType == objectTypeActivity && event.AspectType == aspectTypeDelete:
+		return processActivityDelete(event)
+	case isDeauthorization(event):
+		return processDeauthorization(event)
+	}
+	fmt.Printf("Nothing to do for %s %s event of %d\n", event.ObjectType, event.AspectType, event.ObjectId)
+	return nil
+}
+
+// processActivityCreate stores a freshly uploaded activity and, when new runs are classified, names it after the kind
+// of training it was and celebrates its personal records in the name and the description. Weekly summaries are posted
+// by the scheduler instead.
+func processActivityCreate(event WebhookEvent) error {
+	accessToken, err := getAccessTokenForAthlete(event.OwnerId)
+	if err != nil {
+		return fmt.Errorf("failed to get the access token: %w", err)
+	}
+	// The activity is stored whatever is done with it next, recaps and comparisons read it from the store
+	workout, err := detailedActivity(event.ObjectId, accessToken, 1)
+	if err != nil {
+		return fmt.Errorf("failed to fetch workout: %w", err)
+	}
+	// Records are kept like the activity, so recaps celebrate them even when the activity isn't named
+	records, err := detectPersonalRecords(workout, accessToken, 1)
+	if err != nil {
+		// Records are a bonus, the activity is still named without them
+		fmt.Printf("Failed to detect the records of activity %d: %s\n", workout.ID, err)
+	}
+	if !config.Features.ClassifyNewRuns {
+		fmt.Printf("Naming new runs is turned off, activity %d is only stored\n", event.ObjectId)
+		return nil
+	}
+
+	// A retried or re-delivered event must not rename the same activity twice.
+	processed, err := hasActivityChange(event.ObjectId, sourceClassifier)
+	if err != nil {
+		return fmt.Errorf("failed to check the activity history: %w", err)
+	}
+	if processed {
+		fmt.Printf("Activity %d was already named, skipping\n", event.ObjectId)
+		return nil
+	}
+
+	settings := settingsOrDefault(event.OwnerId)
+	if reason := settings.skipReason(workout); reason != "" {
+		fmt.Printf("Activity %d is %s, not naming it\n", workout.ID, reason)
+		return nil
+	}
+
+	// The hashtags Stratonova followed are removed from what it writes back, from the name too when it's kept
+	_, cleaned := readHashtags(workout)
+	name, description := cleaned.Name, cleaned.Description
+	if kind, ok := classifyWorkout(workout); ok && settings.Rename {
+		name = recordsTitle(settings.locale().translate(kind), records)
+	}
+	if len(records) > 0 {
+		description = strings.TrimSpace(description + "\n\n" + recordsLine(records))
+	}
+	if name == strings.TrimSpace(workout.Name) && description == strings.TrimSpace(workout.Description) {
+		fmt.Printf("Nothing to write on activity %d, a %s of athlete %d\n", workout.ID, workout.SportType, event.OwnerId)
+		return nil
+	}
+	return updateWorkout(workout.ID, description, name, accessToken, sourceClassifier)
+}
+
+// processActivityUpdate keeps the history of activities Stratonova changed complete when the athlete edits them on
+// Strava afterwards, so an undo never brings back a stale title. The stored activity gets all the updates.
+func processActivityUpdate(event WebhookEvent) error {
+	for field, value := range event.Updates {
+		fmt.Printf("Activity %d of athlete %d updated on Strava: %s=%s\n", event.ObjectId, event.OwnerId, field, value)
+	}
+	err := updateStoredActivity(event.ObjectId, func(w *Workout) {
+		applyActivityUpdates(w, event.Updates)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update the stored activity: %w", err)
+	}
+
+	title, ok := event.Updates["title"]
+	if !ok {
+		return nil
+	}
+
+	changes, err := listActivityChanges(event.ObjectId)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 || changes[0].NewName == title {
+		// Either Stratonova never touched this activity or this is the echo of our own update.
+		return nil
+	}
+
+	latest := changes[0]
+	_, err = recordActivityChange(ActivityChange{
+		ActivityID:          event.ObjectId,
+		AthleteID:           event.OwnerId,
+		PreviousName:        latest.NewName,
+		PreviousDescription: latest.NewDescription,
+		NewName:             title,
+		NewDescription:      latest.NewDescription,
+		Source:              sourceAthlete,
+		Applied:             true,
+	})
+	return err
+}
+
+// processActivityDelete drops everything stored about an activity that no longer exists on Strava.
+func processActivityDelete(event WebhookEvent) error {
+	fmt.Printf("Activity %d of athlete %d was deleted, purging its history and records\n", event.ObjectId, event.OwnerId)
+	err := deleteActivityChanges(event.ObjectId)
+	if err != nil {
+		return err
+	}
+	err = deleteStoredActivity(event.ObjectId)
+	if err != nil {
+		return err
+	}
+	return deleteActivityRecords(event.ObjectId)
+}
+
+// processDeauthorization revokes the athlete's tokens and purges their data once they disconnected Stratonova.
+func processDeauthorization(event WebhookEvent) error {
+	athleteID := event.ObjectId
+	fmt.Printf("Athlete %d deauthorized Stratonova, revoking tokens and purging data\n", athleteID)
+	return purgeAthleteData(athleteID)
+}
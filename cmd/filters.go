@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// gearPattern matches Strava gear ids, b for bikes and g for shoes.
+var gearPattern = regexp.MustCompile(`^[bg][0-9]+$`)
+
+// ActivityFilters are the activities the athlete doesn't want Stratonova to touch. The filters apply alike to
+// naming, recaps and backfills, a filtered out activity is neither renamed nor mentioned in a summary.
+type ActivityFilters struct {
+	SkipCommutes bool `json:"skip_commutes"`
+	SkipTrainer  bool `json:"skip_trainer"`
+	// SkipPrivate skips the activities only the athlete can see.
+	SkipPrivate bool `json:"skip_private"`
+	SkipManual  bool `json:"skip_manual"`
+	// MinDistance is in meters, activities without a distance, like strength sessions, are kept.
+	MinDistance float64 `json:"min_distance"`
+	// MinDuration is the minimum moving time in seconds.
+	MinDuration   int      `json:"min_duration"`
+	ExcludeSports []string `json:"exclude_sports"`
+	ExcludeGear   []string `json:"exclude_gear"`
+}
+
+// parseFilters reads the filters the way they are stored, as JSON, no filters when empty.
+func parseFilters(value string) (ActivityFilters, error) {
+	var filters ActivityFilters
+	if value == "" {
+		return filters, nil
+	}
+	err := json.Unmarshal([]byte(value), &filters)
+	return filters, err
+}
+
+func (f ActivityFilters) problems() []string {
+	var problems []string
+	if f.MinDistance < 0 {
+		problems = append(problems, "the minimum distance can't be negative")
+	}
+	if f.MinDuration < 0 {
+		problems = append(problems, "the minimum duration can't be negative")
+	}
+	for _, sport := range f.ExcludeSports {
+		if !sportTypePattern.MatchString(sport) {
+			problems = append(problems, fmt.Sprintf("invalid excluded sport type %q, expected a Strava sport type like Run or Ride", sport))
+		}
+	}
+	for _, gear := range f.ExcludeGear {
+		if !gearPattern.MatchString(gear) {
+			problems = append(problems, fmt.Sprintf("invalid excluded gear %q, expected a Strava gear id like b1234 or g1234", gear))
+		}
+	}
+	if len(f.ExcludeSports)+len(f.ExcludeGear) > 50 {
+		problems = append(problems, "too many exclusions")
+	}
+	return problems
+}
+
+// skipReason tells why the athlete doesn't want Stratonova to process the activity, nothing when it should be
+// processed.
+func (s AthleteSettings) skipReason(w Workout) string {
+	f := s.Filters
+	tags, _ := readHashtags(w)
+	switch {
+	case tags.Skip:
+		return "tagged #nostrato"
+	case len(s.Sports) > 0 && !contains(s.Sports, w.SportType), contains(f.ExcludeSports, w.SportType):
+		return fmt.Sprintf("a %s", w.SportType)
+	case f.SkipCommutes && w.Commute:
+		return "a commute"
+	case f.SkipTrainer && w.Trainer:
+		return "on a trainer"
+	case f.SkipPrivate && (w.Private || w.Visibility == "only_me"):
+		return "private"
+	case f.SkipManual && w.Manual:
+		return "a manual entry"
+	case w.Distance > 0 && w.Distance < f.MinDistance:
+		return fmt.Sprintf("shorter than %.0f m", f.MinDistance)
+	case w.Duration < f.MinDuration:
+		return fmt.Sprintf("shorter than %s", time.Duration(f.MinDuration)*time.Second)
+	case w.GearID != "" && contains(f.ExcludeGear, w.GearID):
+		return fmt.Sprintf("done with gear %s", w.GearID)
+	}
+	return ""
+}
+
+// processes tells whether the athlete wants Stratonova to process the activity.
+func (s AthleteSettings) processes(w Workout) bool {
+	return s.skipReason(w) == ""
+}
+
+// filterWorkouts keeps the workouts the athlete wants processed.
+func (s AthleteSettings) filterWorkouts(workouts []Workout) []Workout {
+	var kept []Workout
+	for _, w := range workouts {
+		if s.processes(w) {
+			kept = append(kept, w)
+		}
+	}
+	return kept
+}
+
+// distanceInUnits converts meters to kilometers or miles, the way the settings page shows the minimum distance.
+func distanceInUnits(meters float64, units string) float64 {
+	if units == unitsImperial {
+		return meters / metersPerMile
+	}
+	return meters / 1000
+}
+
+// metersFromUnits converts kilometers or miles back to meters.
+func metersFromUnits(distance float64, units string) float64 {
+	if units == unitsImperial {
+		return distance * metersPerMile
+	}
+	return distance * 1000
+}
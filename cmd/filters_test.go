@@ -0,0 +1,128 @@
+package main
+
+import "testing"
+
+func TestSkipReason(t *testing.T) {
+	run := Workout{ID: 1, Name: "Morning Run", SportType: "Run", Distance: 8000, Duration: 2400, GearID: "g42", Visibility: "everyone"}
+	tests := []struct {
+		name     string
+		settings AthleteSettings
+		modify   func(w *Workout)
+		want     string
+	}{
+		{
+			name: "no filters",
+			want: "",
+		},
+		{
+			name:   "no filters keep commutes",
+			modify: func(w *Workout) { w.Commute = true },
+			want:   "",
+		},
+		{
+			name:   "tagged #nostrato",
+			modify: func(w *Workout) { w.Description = "Legs were dead #nostrato" },
+			want:   "tagged #nostrato",
+		},
+		{
+			name:     "#nostrato wins over the filters",
+			settings: AthleteSettings{Filters: ActivityFilters{SkipCommutes: true}},
+			modify:   func(w *Workout) { w.Name = "#NoStrato commute"; w.Commute = true },
+			want:     "tagged #nostrato",
+		},
+		{
+			name:     "sport not processed",
+			settings: AthleteSettings{Sports: []string{"Ride", "Swim"}},
+			want:     "a Run",
+		},
+		{
+			name:     "sport processed",
+			settings: AthleteSettings{Sports: []string{"Run"}},
+			want:     "",
+		},
+		{
+			name:     "sport excluded",
+			settings: AthleteSettings{Filters: ActivityFilters{ExcludeSports: []string{"Run"}}},
+			want:     "a Run",
+		},
+		{
+			name:     "commute",
+			settings: AthleteSettings{Filters: ActivityFilters{SkipCommutes: true}},
+			modify:   func(w *Workout) { w.Commute = true },
+			want:     "a commute",
+		},
+		{
+			name:     "trainer",
+			settings: AthleteSettings{Filters: ActivityFilters{SkipTrainer: true}},
+			modify:   func(w *Workout) { w.Trainer = true },
+			want:     "on a trainer",
+		},
+		{
+			name:     "private",
+			settings: AthleteSettings{Filters: ActivityFilters{SkipPrivate: true}},
+			modify:   func(w *Workout) { w.Private = true },
+			want:     "private",
+		},
+		{
+			name:     "only visible to the athlete",
+			settings: AthleteSettings{Filters: ActivityFilters{SkipPrivate: true}},
+			modify:   func(w *Workout) { w.Visibility = "only_me" },
+			want:     "private",
+		},
+		{
+			name:     "visible to followers",
+			settings: AthleteSettings{Filters: ActivityFilters{SkipPrivate: true}},
+			modify:   func(w *Workout) { w.Visibility = "followers_only" },
+			want:     "",
+		},
+		{
+			name:     "manual entry",
+			settings: AthleteSettings{Filters: ActivityFilters{SkipManual: true}},
+			modify:   func(w *Workout) { w.Manual = true },
+			want:     "a manual entry",
+		},
+		{
+			name:     "too short",
+			settings: AthleteSettings{Filters: ActivityFilters{MinDistance: 10000}},
+			want:     "shorter than 10000 m",
+		},
+		{
+			name:     "without a distance",
+			settings: AthleteSettings{Filters: ActivityFilters{MinDistance: 10000}},
+			modify:   func(w *Workout) { w.SportType = "WeightTraining"; w.Distance = 0 },
+			want:     "",
+		},
+		{
+			name:     "too brief",
+			settings: AthleteSettings{Filters: ActivityFilters{MinDuration: 3000}},
+			want:     "shorter than 50m0s",
+		},
+		{
+			name:     "long enough",
+			settings: AthleteSettings{Filters: ActivityFilters{MinDistance: 8000, MinDuration: 2400}},
+			want:     "",
+		},
+		{
+			name:     "gear excluded",
+			settings: AthleteSettings{Filters: ActivityFilters{ExcludeGear: []string{"b7", "g42"}}},
+			want:     "done with gear g42",
+		},
+		{
+			name:     "without gear",
+			settings: AthleteSettings{Filters: ActivityFilters{ExcludeGear: []string{"g42"}}},
+			modify:   func(w *Workout) { w.GearID = "" },
+			want:     "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := run
+			if tt.modify != nil {
+				tt.modify(&w)
+			}
+			if got := tt.settings.skipReason(w); got != tt.want {
+				t.Errorf("skipReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
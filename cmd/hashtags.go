@@ -0,0 +1,95 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// hashtagPattern matches the hashtags athletes write in an activity's name or description to tell Stratonova about
+// it: #nostrato to be left alone, #race, #injured, #treadmill, and #tone=funny to pick the tone of the description.
+var hashtagPattern = regexp.MustCompile(`(?i)[ \t]*#(nostrato|race|injured|treadmill|tone=[a-z-]+)\b`)
+
+// ActivityTags are the hashtags found on an activity.
+type ActivityTags struct {
+	Skip      bool
+	Race      bool
+	Injured   bool
+	Treadmill bool
+	// Tone overrides the athlete's tone for this activity.
+	Tone string
+}
+
+// parseHashtags returns the hashtags in the text, and the text without them. Unknown hashtags, and tones that
+// aren't one of tones, are left in the text.
+func parseHashtags(text string) (ActivityTags, string) {
+	var tags ActivityTags
+	cleaned := hashtagPattern.ReplaceAllStringFunc(text, func(match string) string {
+		tag := strings.ToLower(strings.TrimLeft(match, " \t#"))
+		switch tag {
+		case "nostrato":
+			tags.Skip = true
+		case "race":
+			tags.Race = true
+		case "injured":
+			tags.Injured = true
+		case "treadmill":
+			tags.Treadmill = true
+		default:
+			tone := strings.TrimPrefix(tag, "tone=")
+			if !contains(tones, tone) {
+				return match
+			}
+			tags.Tone = tone
+		}
+		return ""
+	})
+	return tags, strings.TrimSpace(cleaned)
+}
+
+// readHashtags returns the hashtags of the activity's name and description, and the activity without them.
+func readHashtags(w Workout) (ActivityTags, Workout) {
+	nameTags, name := parseHashtags(w.Name)
+	descriptionTags, description := parseHashtags(w.Description)
+
+	w.Name, w.Description = name, description
+	return ActivityTags{
+		Skip:      nameTags.Skip || descriptionTags.Skip,
+		Race:      nameTags.Race || descriptionTags.Race,
+		Injured:   nameTags.Injured || descriptionTags.Injured,
+		Treadmill: nameTags.Treadmill || descriptionTags.Treadmill,
+		// The description is where athletes write more, it wins over the name
+		Tone: firstNonEmpty(descriptionTags.Tone, nameTags.Tone),
+	}, w
+}
+
+// notes tells the coach what the hashtags said, to add to the activity in a prompt.
+func (t ActivityTags) notes() string {
+	var notes []string
+	if t.Race {
+		notes = append(notes, "It was a race.")
+	}
+	if t.Injured {
+		notes = append(notes, "I'm injured, so take it easy on me and mention recovery.")
+	}
+	if t.Treadmill {
+		notes = append(notes, "It was on a treadmill, the pace and distance come from the treadmill.")
+	}
+	return strings.Join(notes, " ")
+}
+
+// applyTo returns the athlete's settings with the overrides of the hashtags.
+func (t ActivityTags) applyTo(settings AthleteSettings) AthleteSettings {
+	if t.Tone != "" {
+		settings.Tone = t.Tone
+	}
+	return settings
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+
+func TestParseHashtags(t *testing.T) {
+	tests := []struct {
+		text        string
+		wantTags    ActivityTags
+		wantCleaned string
+	}{
+		{"Morning Run", ActivityTags{}, "Morning Run"},
+		{"", ActivityTags{}, ""},
+		{"Morning Run #race", ActivityTags{Race: true}, "Morning Run"},
+		{"#nostrato", ActivityTags{Skip: true}, ""},
+		{"Parkrun #RACE #Injured", ActivityTags{Race: true, Injured: true}, "Parkrun"},
+		{"Hill reps #treadmill\nfelt good", ActivityTags{Treadmill: true}, "Hill reps\nfelt good"},
+		{"#tone=funny Long one", ActivityTags{Tone: "funny"}, "Long one"},
+		{"Tempo #Tone=Straight-Talking", ActivityTags{Tone: "straight-talking"}, "Tempo"},
+		{"Tempo #tone=grumpy", ActivityTags{}, "Tempo #tone=grumpy"},
+		{"#racecar weekend", ActivityTags{}, "#racecar weekend"},
+		{"Marathon block #marathon #race", ActivityTags{Race: true}, "Marathon block #marathon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			tags, cleaned := parseHashtags(tt.text)
+			if tags != tt.wantTags {
+				t.Errorf("parseHashtags() tags = %+v, want %+v", tags, tt.wantTags)
+			}
+			if cleaned != tt.wantCleaned {
+				t.Errorf("parseHashtags() text = %q, want %q", cleaned, tt.wantCleaned)
+			}
+		})
+	}
+}
+
+func TestReadHashtags(t *testing.T) {
+	tests := []struct {
+		name            string
+		workout         Workout
+		wantTags        ActivityTags
+		wantName        string
+		wantDescription string
+	}{
+		{
+			name:            "name and description",
+			workout:         Workout{Name: "Sunday long run #injured", Description: "Easy does it #tone=motivating"},
+			wantTags:        ActivityTags{Injured: true, Tone: "motivating"},
+			wantName:        "Sunday long run",
+			wantDescription: "Easy does it",
+		},
+		{
+			name:            "the description's tone wins",
+			workout:         Workout{Name: "#tone=funny Run", Description: "#tone=friendly"},
+			wantTags:        ActivityTags{Tone: "friendly"},
+			wantName:        "Run",
+			wantDescription: "",
+		},
+		{
+			name:            "skip from the description",
+			workout:         Workout{Name: "Recovery", Description: "#nostrato please"},
+			wantTags:        ActivityTags{Skip: true},
+			wantName:        "Recovery",
+			wantDescription: "please",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags, cleaned := readHashtags(tt.workout)
+			if tags != tt.wantTags {
+				t.Errorf("readHashtags() tags = %+v, want %+v", tags, tt.wantTags)
+			}
+			if cleaned.Name != tt.wantName || cleaned.Description != tt.wantDescription {
+				t.Errorf("readHashtags() = %q / %q, want %q / %q", cleaned.Name, cleaned.Description, tt.wantName, tt.wantDescription)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Sources recorded alongside every change, so the history tells who rewrote an activity.
+const (
+	sourceUpdateWorkout = "update_workout"
+	sourceWeeklyRecap   = "weekly_recap"
+	sourceClassifier    = "classifier"
+	sourceUndo          = "undo"
+)
+
+// ActivityChange is a snapshot of a Strava activity's name and description right before Stratonova overwrote them.
+// The snapshot is taken before Strava is asked for the change, and the change is applied once Strava took it.
+type ActivityChange struct {
+	ID                  int       `json:"id"`
+	ActivityID          int       `json:"activity_id"`
+	AthleteID           int       `json:"athlete_id"`
+	PreviousName        string    `json:"previous_name"`
+	PreviousDescription string    `json:"previous_description"`
+	NewName             string    `json:"new_name"`
+	NewDescription      string    `json:"new_description"`
+	Source              string    `json:"source"`
+	Applied             bool      `json:"applied"`
+	CreatedAt           time.Time `json:"created_at"`
+}
+
+func createActivityHistoryTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS strava_activity_history (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		activity_id BIGINT NOT NULL,
+		athlete_id BIGINT NOT NULL,
+		previous_name TEXT NOT NULL,
+		previous_description TEXT NOT NULL,
+		new_name TEXT NOT NULL,
+		new_description TEXT NOT NULL,
+		source VARCHAR(32) NOT NULL,
+		applied BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at DATETIME NOT NULL,
+		INDEX (activity_id)
+	);`)
+	if err != nil {
+		return err
+	}
+	return addColumnIfMissing(db, "strava_activity_history", "applied", "BOOLEAN NOT NULL DEFAULT TRUE")
+}
+
+// recordActivityChange stores the change and returns its id.
+func recordActivityChange(change ActivityChange) (int, error) {
+	db, err := database()
+	if err != nil {
+		return 0, err
+	}
+
+	err = createActivityHistoryTable(db)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := db.Exec("INSERT INTO strava_activity_history (activity_id, athlete_id, previous_name, previous_description, new_name, new_description, source, applied, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);",
+		change.ActivityID, change.AthleteID, change.PreviousName, change.PreviousDescription, change.NewName, change.NewDescription, change.Source, change.Applied, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// markActivityChangeApplied records that Strava took the change.
+func markActivityChangeApplied(changeID int) error {
+	db, err := database()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE strava_activity_history SET applied=TRUE WHERE id=?;", changeID)
+	return err
+}
+
+// deleteActivityChange drops the snapshot of a change Strava refused, there is nothing to undo.
+func deleteActivityChange(changeID int) error {
+	db, err := database()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM strava_activity_history WHERE id=?;", changeID)
+	return err
+}
+
+// listActivityChanges returns the changes made to an activity, newest first.
+func listActivityChanges(activityID int) ([]ActivityChange, error) {
+	db, err := database()
+	if err != nil {
+		return nil, err
+	}
+
+	err = createActivityHistoryTable(db)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, activity_id, athlete_id, previous_name, previous_description, new_name, new_description, source, applied, created_at FROM strava_activity_history WHERE activity_id=? ORDER BY id DESC;", activityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []ActivityChange{}
+	for rows.Next() {
+		var c ActivityChange
+		err = rows.Scan(&c.ID, &c.ActivityID, &c.AthleteID, &c.PreviousName, &c.PreviousDescription, &c.NewName, &c.NewDescription, &c.Source, &c.Applied, &c.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// hasActivityChange reports whether the activity was already changed by the given source. A change that was never
+// marked applied counts too, Strava may have taken it before the process stopped.
+func hasActivityChange(activityID int, source string) (bool, error) {
+	db, err := database()
+	if err != nil {
+		return false, err
+	}
+
+	err = createActivityHistoryTable(db)
+	if err != nil {
+		return false, err
+	}
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM strava_activity_history WHERE activity_id=? AND source=?;", activityID, source).Scan(&count)
+	return count > 0, err
+}
+
+// deleteActivityChanges removes the whole history of an activity.
+func deleteActivityChanges(activityID int) error {
+	db, err := database()
+	if err != nil {
+		return err
+	}
+
+	err = createActivityHistoryTable(db)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM strava_activity_history WHERE activity_id=?;", activityID)
+	return err
+}
+
+func getActivityChange(changeID int) (ActivityChange, error) {
+	db, err := database()
+	if err != nil {
+		return ActivityChange{}, err
+	}
+
+	var c ActivityChange
+	err = db.QueryRow("SELECT id, activity_id, athlete_id, previous_name, previous_description, new_name, new_description, source, applied, created_at FROM strava_activity_history WHERE id=?;", changeID).
+		Scan(&c.ID, &c.ActivityID, &c.AthleteID, &c.PreviousName, &c.PreviousDescription, &c.NewName, &c.NewDescription, &c.Source, &c.Applied, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return ActivityChange{}, fmt.Errorf("no activity change with id %d", changeID)
+	}
+	return c, err
+}
+
+// undoActivityChange puts back the name and description an activity had before the given change. The restore is a
+// write like any other, so it is recorded in the history too and can itself be undone.
+func undoActivityChange(changeID int, accessToken string) (ActivityChange, error) {
+	change, err := getActivityChange(changeID)
+	if err != nil {
+		return ActivityChange{}, err
+	}
+
+	err = updateWorkout(change.ActivityID, change.PreviousDescription, change.PreviousName, accessToken, sourceUndo)
+	if err != nil {
+		return ActivityChange{}, err
+	}
+	return change, nil
+}
+
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	workoutID, err := strconv.Atoi(r.URL.Query().Get("workout_id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid activity id 🙃🙃🙃: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	changes, err := listActivityChanges(workoutID)
+	if err != nil {
+		fmt.Println("Failed to list activity changes:", err)
+		http.Error(w, "Failed to list activity changes", http.StatusInternalServerError)
+		return
+	}
+	for _, change := range changes {
+		if !authorizeAthlete(w, r, change.AthleteID) {
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
+
+func undoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Sorry, only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	changeID, err := strconv.Atoi(r.URL.Query().Get("change_id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid change id 🙃🙃🙃: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	change, err := getActivityChange(changeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !authorizeAthlete(w, r, change.AthleteID) {
+		return
+	}
+
+	accessToken, err := getAccessTokenForAthlete(change.AthleteID)
+	if err != nil {
+		fmt.Println("Failed to get the access token:", err)
+		http.Error(w, "Failed to get the Strava access token", http.StatusInternalServerError)
+		return
+	}
+	change, err = undoActivityChange(changeID, accessToken)
+	if err != nil {
+		fmt.Println("Failed to undo activity change:", err)
+		http.Error(w, "Failed to undo activity change", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Workout %d restored to %q successfully!", change.ActivityID, change.PreviousName)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Webhook jobs move from pending to running, and end up either done or, once they ran out of attempts, dead.
+const (
+	jobStatusPending = "pending"
+	jobStatusRunning = "running"
+	jobStatusDone    = "done"
+	jobStatusDead    = "dead"
+)
+
+const (
+	defaultWebhookWorkers = 2
+	maxJobAttempts        = 5
+	jobPollInterval       = 5 * time.Second
+	jobBaseBackoff        = 30 * time.Second
+	jobMaxBackoff         = time.Hour
+	// A job that has been running for this long is assumed to belong to an instance that crashed.
+	jobStaleAfter = 15 * time.Minute
+)
+
+type WebhookJob struct {
+	ID        int
+	Payload   []byte
+	Attempts  int
+	LastError string
+}
+
+func createWebhookJobsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS webhook_jobs (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		payload TEXT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at DATETIME NOT NULL,
+		last_error TEXT,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		INDEX (status, next_attempt_at)
+	);`)
+	return err
+}
+
+func createProcessedWebhookEventsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS processed_webhook_events (
+		subscription_id BIGINT NOT NULL,
+		object_id BIGINT NOT NULL,
+		aspect_type VARCHAR(16) NOT NULL,
+		event_time BIGINT NOT NULL,
+		job_id INT NOT NULL,
+		received_at DATETIME NOT NULL,
+		PRIMARY KEY (subscription_id, object_id, aspect_type, event_time)
+	);`)
+	return err
+}
+
+// enqueueWebhookJob durably stores a webhook event so it survives until a worker has processed it. Strava retries
+// deliveries and may send the same event more than once, possibly to different Cloud Run instances, so events are
+// keyed on (subscription, object_id, aspect_type, event_time) and a duplicate is not enqueued again. It reports
+// whether the event was new.
+func enqueueWebhookJob(event WebhookEvent, payload []byte) (bool, error) {
+	db, err := database()
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	res, err := tx.Exec("INSERT INTO webhook_jobs (payload, status, attempts, next_attempt_at, created_at, updated_at) VALUES (?, ?, 0, ?, ?, ?);",
+		string(payload), jobStatusPending, now, now, now)
+	if err != nil {
+		return false, err
+	}
+	jobID, err := res.LastInsertId()
+	if err != nil {
+		return false, err
+	}
+
+	// The primary key makes this insert a no-op for an event that was already received, even when two instances
+	// race on the same delivery.
+	res, err = tx.Exec("INSERT IGNORE INTO processed_webhook_events (subscription_id, object_id, aspect_type, event_time, job_id, received_at) VALUES (?, ?, ?, ?, ?, ?);",
+		event.SubscriptionId, event.ObjectId, event.AspectType, event.EventTime, jobID, now)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if inserted == 0 {
+		return false, nil
+	}
+	return true, tx.Commit()
+}
+
+// claimWebhookJob locks the next due job for this worker. Several Cloud Run instances can poll the same table, and
+// SKIP LOCKED makes sure each job is handed to only one of them. It returns nil when there's nothing to do.
+func claimWebhookJob(db *sql.DB) (*WebhookJob, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var job WebhookJob
+	var lastError sql.NullString
+	err = tx.QueryRow("SELECT id, payload, attempts, last_error FROM webhook_jobs WHERE (status=? AND next_attempt_at<=?) OR (status=? AND updated_at<?) ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED;",
+		jobStatusPending, now, jobStatusRunning, now.Add(-jobStaleAfter)).
+		Scan(&job.ID, &job.Payload, &job.Attempts, &lastError)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	job.LastError = lastError.String
+	job.Attempts++
+
+	_, err = tx.Exec("UPDATE webhook_jobs SET status=?, attempts=?, updated_at=? WHERE id=?;", jobStatusRunning, job.Attempts, now, job.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &job, tx.Commit()
+}
+
+func completeWebhookJob(db *sql.DB, job *WebhookJob) error {
+	_, err := db.Exec("UPDATE webhook_jobs SET status=?, updated_at=? WHERE id=?;", jobStatusDone, time.Now(), job.ID)
+	return err
+}
+
+// failWebhookJob schedules the job for another attempt with exponential backoff, or moves it to the dead-letter
+// state once it has been attempted maxJobAttempts times.
+func failWebhookJob(db *sql.DB, job *WebhookJob, jobErr error) error {
+	now := time.Now()
+	status, nextAttempt := retryWebhookJob(job.Attempts, now)
+	if status == jobStatusDead {
+		_, err := db.Exec("UPDATE webhook_jobs SET status=?, last_error=?, updated_at=? WHERE id=?;", jobStatusDead, jobErr.Error(), now, job.ID)
+		return err
+	}
+
+	_, err := db.Exec("UPDATE webhook_jobs SET status=?, last_error=?, next_attempt_at=?, updated_at=? WHERE id=?;",
+		status, jobErr.Error(), nextAttempt, now, job.ID)
+	return err
+}
+
+// retryWebhookJob returns the status a job moves to once its attempt failed and, unless it's dead, when it's due
+// again.
+func retryWebhookJob(attempts int, now time.Time) (string, time.Time) {
+	if attempts >= maxJobAttempts {
+		return jobStatusDead, time.Time{}
+	}
+	return jobStatusPending, now.Add(jobBackoff(attempts))
+}
+
+// jobBackoff doubles the wait after every failed attempt, up to jobMaxBackoff.
+func jobBackoff(attempts int) time.Duration {
+	backoff := jobBaseBackoff
+	for i := 1; i < attempts && backoff < jobMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > jobMaxBackoff {
+		return jobMaxBackoff
+	}
+	return backoff
+}
+
+func runWebhookJob(job *WebhookJob) error {
+	var event WebhookEvent
+	err := json.Unmarshal(job.Payload, &event)
+	if err != nil {
+		return fmt.Errorf("failed to parse queued event: %w", err)
+	}
+	return processWebhookEvent(event)
+}
+
+// startWebhookWorkers starts a pool of workers that keep processing queued webhook jobs.
+func startWebhookWorkers(workers int) {
+	for i := 0; i < workers; i++ {
+		go webhookWorker(i)
+	}
+}
+
+func webhookWorker(worker int) {
+	var db *sql.DB
+	for {
+		if db == nil {
+			var err error
+			db, err = database()
+			if err != nil {
+				fmt.Printf("worker %d: failed to connect to the database: %s\n", worker, err)
+				time.Sleep(jobPollInterval)
+				continue
+			}
+		}
+
+		job, err := claimWebhookJob(db)
+		if err != nil {
+			fmt.Printf("worker %d: failed to claim a job: %s\n", worker, err)
+			time.Sleep(jobPollInterval)
+			continue
+		}
+		if job == nil {
+			time.Sleep(jobPollInterval)
+			continue
+		}
+
+		fmt.Printf("worker %d: processing job %d (attempt %d)\n", worker, job.ID, job.Attempts)
+		err = runWebhookJob(job)
+		if err != nil {
+			fmt.Printf("worker %d: job %d failed: %s\n", worker, job.ID, err)
+			err = failWebhookJob(db, job, err)
+		} else {
+			err = completeWebhookJob(db, job)
+		}
+		if err != nil {
+			fmt.Printf("worker %d: failed to update job %d: %s\n", worker, job.ID, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{50, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := jobBackoff(tt.attempts); got != tt.want {
+			t.Errorf("jobBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestRetryWebhookJob(t *testing.T) {
+	now := time.Date(2024, 5, 12, 18, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name            string
+		attempts        int
+		wantStatus      string
+		wantNextAttempt time.Time
+	}{
+		{"first attempt failed", 1, jobStatusPending, now.Add(30 * time.Second)},
+		{"backoff doubles", 3, jobStatusPending, now.Add(2 * time.Minute)},
+		{"last retry", maxJobAttempts - 1, jobStatusPending, now.Add(jobBackoff(maxJobAttempts - 1))},
+		{"out of attempts", maxJobAttempts, jobStatusDead, time.Time{}},
+		{"claimed again after a crash", maxJobAttempts + 1, jobStatusDead, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, nextAttempt := retryWebhookJob(tt.attempts, now)
+			if status != tt.wantStatus || !nextAttempt.Equal(tt.wantNextAttempt) {
+				t.Errorf("retryWebhookJob(%d) = %s, %s, want %s, %s", tt.attempts, status, nextAttempt, tt.wantStatus, tt.wantNextAttempt)
+			}
+		})
+	}
+}
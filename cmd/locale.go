@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Locale is how numbers, dates, durations and Stratonova's own texts, like the classifier's names, are written for an
+// athlete: in their units, and in their language when there's a catalog for it. Other languages get the English
+// catalog, the summaries are still written in them.
+type Locale struct {
+	Units   string
+	catalog catalog
+}
+
+type catalog struct {
+	language string
+	decimal  string
+	// minute is the minutes suffix of durations, "1h 5m"
+	minute string
+	// weekdays start on Sunday, like time.Weekday
+	weekdays [7]string
+	months   [12]string
+	// names translates the classifier's names and the other texts Stratonova writes on Strava, keyed by the English
+	// text
+	names map[string]string
+}
+
+var englishCatalog = catalog{
+	language: "English",
+	decimal:  ".",
+	minute:   "m",
+	weekdays: [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+	months:   [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+}
+
+// englishLocale is for the logs and the CLI.
+var englishLocale = Locale{Units: unitsMetric, catalog: englishCatalog}
+
+// catalogs are the languages Stratonova translates its texts into.
+var catalogs = []catalog{
+	englishCatalog,
+	{
+		language: "Spanish",
+		decimal:  ",",
+		minute:   "min",
+		weekdays: [7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+		months:   [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		names: map[string]string{
+			"Short but Sweet 💁🏽‍♂️":   "Corta pero sabrosa 💁🏽‍♂️",
+			"Long Run ☄️":             "Tirada larga ☄️",
+			"Interval training 💪🛤️":   "Series 💪🛤️",
+			"Threshold Training 🚀🚀🚀":  "Entrenamiento de umbral 🚀🚀🚀",
+			"Easy Flow 🌊🌊":            "Rodaje suave 🌊🌊",
+			"VO2 Max Ride 🔥🚴":         "Salida VO2 máx 🔥🚴",
+			"Sweet Spot Ride 🍯🚴":      "Salida sweet spot 🍯🚴",
+			"Recovery Spin 🌀":         "Vuelta de recuperación 🌀",
+			"Long Endurance Ride 🚴☄️": "Fondo largo 🚴☄️",
+			"Endurance Ride 🚴🌄":       "Salida de fondo 🚴🌄",
+			"Swim Sets 🏊⏱️":           "Series de natación 🏊⏱️",
+			"Technique Swim 🐟":        "Natación técnica 🐟",
+			"Long Swim 🐋":             "Nado largo 🐋",
+			"Endurance Swim 🌊🏊":       "Nado de fondo 🌊🏊",
+			"Mountain Hike 🏔️":        "Ruta de montaña 🏔️",
+			"Mountain Walk 🏔️":        "Caminata de montaña 🏔️",
+			"Easy Hike 🚶":             "Ruta tranquila 🚶",
+			"Easy Walk 🚶":             "Paseo tranquilo 🚶",
+			"Yoga Flow 🧘":             "Sesión de yoga 🧘",
+			"Pilates Flow 🧘":          "Sesión de pilates 🧘",
+			"HIIT Session 🔥💪":         "Sesión HIIT 🔥💪",
+			"Strength Session 🏋️":     "Sesión de fuerza 🏋️",
+			"Race Day 🏁":              "Día de carrera 🏁",
+			"Treadmill %s":            "Cinta: %s",
+			"week":                    "semana",
+			"weeks":                   "semanas",
+		},
+	},
+	{
+		language: "German",
+		decimal:  ",",
+		minute:   "min",
+		weekdays: [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		months:   [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		names: map[string]string{
+			"Short but Sweet 💁🏽‍♂️":   "Kurz und knackig 💁🏽‍♂️",
+			"Long Run ☄️":             "Langer Lauf ☄️",
+			"Interval training 💪🛤️":   "Intervalltraining 💪🛤️",
+			"Threshold Training 🚀🚀🚀":  "Schwellentraining 🚀🚀🚀",
+			"Easy Flow 🌊🌊":            "Lockerer Lauf 🌊🌊",
+			"VO2 Max Ride 🔥🚴":         "VO2max-Fahrt 🔥🚴",
+			"Sweet Spot Ride 🍯🚴":      "Sweet-Spot-Fahrt 🍯🚴",
+			"Recovery Spin 🌀":         "Regenerationsfahrt 🌀",
+			"Long Endurance Ride 🚴☄️": "Lange Grundlagenfahrt 🚴☄️",
+			"Endurance Ride 🚴🌄":       "Grundlagenfahrt 🚴🌄",
+			"Swim Sets 🏊⏱️":           "Schwimmserien 🏊⏱️",
+			"Technique Swim 🐟":        "Techniktraining 🐟",
+			"Long Swim 🐋":             "Langes Schwimmen 🐋",
+			"Endurance Swim 🌊🏊":       "Ausdauerschwimmen 🌊🏊",
+			"Mountain Hike 🏔️":        "Bergwanderung 🏔️",
+			"Mountain Walk 🏔️":        "Bergspaziergang 🏔️",
+			"Easy Hike 🚶":             "Lockere Wanderung 🚶",
+			"Easy Walk 🚶":             "Lockerer Spaziergang 🚶",
+			"Yoga Flow 🧘":             "Yoga-Flow 🧘",
+			"Pilates Flow 🧘":          "Pilates-Flow 🧘",
+			"HIIT Session 🔥💪":         "HIIT-Einheit 🔥💪",
+			"Strength Session 🏋️":     "Krafttraining 🏋️",
+			"Race Day 🏁":              "Wettkampftag 🏁",
+			"Treadmill %s":            "Laufband: %s",
+			"week":                    "Woche",
+			"weeks":                   "Wochen",
+		},
+	},
+	{
+		language: "French",
+		decimal:  ",",
+		minute:   "min",
+		weekdays: [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		months:   [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		names: map[string]string{
+			"Short but Sweet 💁🏽‍♂️":   "Court mais intense 💁🏽‍♂️",
+			"Long Run ☄️":             "Sortie longue ☄️",
+			"Interval training 💪🛤️":   "Fractionné 💪🛤️",
+			"Threshold Training 🚀🚀🚀":  "Séance au seuil 🚀🚀🚀",
+			"Easy Flow 🌊🌊":            "Footing tranquille 🌊🌊",
+			"VO2 Max Ride 🔥🚴":         "Sortie VO2 max 🔥🚴",
+			"Sweet Spot Ride 🍯🚴":      "Sortie sweet spot 🍯🚴",
+			"Recovery Spin 🌀":         "Sortie de récupération 🌀",
+			"Long Endurance Ride 🚴☄️": "Longue sortie d'endurance 🚴☄️",
+			"Endurance Ride 🚴🌄":       "Sortie d'endurance 🚴🌄",
+			"Swim Sets 🏊⏱️":           "Séries de natation 🏊⏱️",
+			"Technique Swim 🐟":        "Natation technique 🐟",
+			"Long Swim 🐋":             "Longue nage 🐋",
+			"Endurance Swim 🌊🏊":       "Nage d'endurance 🌊🏊",
+			"Mountain Hike 🏔️":        "Randonnée en montagne 🏔️",
+			"Mountain Walk 🏔️":        "Marche en montagne 🏔️",
+			"Easy Hike 🚶":             "Randonnée tranquille 🚶",
+			"Easy Walk 🚶":             "Balade tranquille 🚶",
+			"Yoga Flow 🧘":             "Séance de yoga 🧘",
+			"Pilates Flow 🧘":          "Séance de pilates 🧘",
+			"HIIT Session 🔥💪":         "Séance HIIT 🔥💪",
+			"Strength Session 🏋️":     "Renforcement musculaire 🏋️",
+			"Race Day 🏁":              "Jour de course 🏁",
+			"Treadmill %s":            "Tapis : %s",
+			"week":                    "semaine",
+			"weeks":                   "semaines",
+		},
+	},
+	{
+		language: "Dutch",
+		decimal:  ",",
+		minute:   "min",
+		weekdays: [7]string{"zondag", "maandag", "dinsdag", "woensdag", "donderdag", "vrijdag", "zaterdag"},
+		months:   [12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		names: map[string]string{
+			"Short but Sweet 💁🏽‍♂️":   "Kort maar krachtig 💁🏽‍♂️",
+			"Long Run ☄️":             "Lange duurloop ☄️",
+			"Interval training 💪🛤️":   "Intervaltraining 💪🛤️",
+			"Threshold Training 🚀🚀🚀":  "Drempeltraining 🚀🚀🚀",
+			"Easy Flow 🌊🌊":            "Rustige loop 🌊🌊",
+			"VO2 Max Ride 🔥🚴":         "VO2max-rit 🔥🚴",
+			"Sweet Spot Ride 🍯🚴":      "Sweetspot-rit 🍯🚴",
+			"Recovery Spin 🌀":         "Herstelrit 🌀",
+			"Long Endurance Ride 🚴☄️": "Lange duurrit 🚴☄️",
+			"Endurance Ride 🚴🌄":       "Duurrit 🚴🌄",
+			"Swim Sets 🏊⏱️":           "Zwemseries 🏊⏱️",
+			"Technique Swim 🐟":        "Techniekzwemmen 🐟",
+			"Long Swim 🐋":             "Lange zwemtocht 🐋",
+			"Endurance Swim 🌊🏊":       "Duurzwemmen 🌊🏊",
+			"Mountain Hike 🏔️":        "Bergtocht 🏔️",
+			"Mountain Walk 🏔️":        "Bergwandeling 🏔️",
+			"Easy Hike 🚶":             "Rustige wandeltocht 🚶",
+			"Easy Walk 🚶":             "Rustige wandeling 🚶",
+			"Yoga Flow 🧘":             "Yogaflow 🧘",
+			"Pilates Flow 🧘":          "Pilatesflow 🧘",
+			"HIIT Session 🔥💪":         "HIIT-sessie 🔥💪",
+			"Strength Session 🏋️":     "Krachttraining 🏋️",
+			"Race Day 🏁":              "Wedstrijddag 🏁",
+			"Treadmill %s":            "Loopband: %s",
+			"week":                    "week",
+			"weeks":                   "weken",
+		},
+	},
+	{
+		language: "Italian",
+		decimal:  ",",
+		minute:   "min",
+		weekdays: [7]string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+		months:   [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		names: map[string]string{
+			"Short but Sweet 💁🏽‍♂️":   "Corta ma intensa 💁🏽‍♂️",
+			"Long Run ☄️":             "Lungo ☄️",
+			"Interval training 💪🛤️":   "Ripetute 💪🛤️",
+			"Threshold Training 🚀🚀🚀":  "Allenamento alla soglia 🚀🚀🚀",
+			"Easy Flow 🌊🌊":            "Corsa facile 🌊🌊",
+			"VO2 Max Ride 🔥🚴":         "Uscita VO2 max 🔥🚴",
+			"Sweet Spot Ride 🍯🚴":      "Uscita sweet spot 🍯🚴",
+			"Recovery Spin 🌀":         "Uscita di recupero 🌀",
+			"Long Endurance Ride 🚴☄️": "Lungo di fondo 🚴☄️",
+			"Endurance Ride 🚴🌄":       "Uscita di fondo 🚴🌄",
+			"Swim Sets 🏊⏱️":           "Serie in vasca 🏊⏱️",
+			"Technique Swim 🐟":        "Nuoto tecnico 🐟",
+			"Long Swim 🐋":             "Nuotata lunga 🐋",
+			"Endurance Swim 🌊🏊":       "Nuoto di fondo 🌊🏊",
+			"Mountain Hike 🏔️":        "Escursione in montagna 🏔️",
+			"Mountain Walk 🏔️":        "Camminata in montagna 🏔️",
+			"Easy Hike 🚶":             "Escursione tranquilla 🚶",
+			"Easy Walk 🚶":             "Passeggiata tranquilla 🚶",
+			"Yoga Flow 🧘":             "Sessione di yoga 🧘",
+			"Pilates Flow 🧘":          "Sessione di pilates 🧘",
+			"HIIT Session 🔥💪":         "Sessione HIIT 🔥💪",
+			"Strength Session 🏋️":     "Allenamento di forza 🏋️",
+			"Race Day 🏁":              "Giorno di gara 🏁",
+			"Treadmill %s":            "Tapis roulant: %s",
+			"week":                    "settimana",
+			"weeks":                   "settimane",
+		},
+	},
+}
+
+// nativeLanguageNames lets athletes write their language the way they call it.
+var nativeLanguageNames = map[string]string{
+	"español":    "Spanish",
+	"deutsch":    "German",
+	"français":   "French",
+	"nederlands": "Dutch",
+	"italiano":   "Italian",
+}
+
+// catalogLanguages lists the languages there's a catalog for, for the settings page.
+func catalogLanguages() []string {
+	var languages []string
+	for _, c := range catalogs {
+		languages = append(languages, c.language)
+	}
+	return languages
+}
+
+// locale returns the athlete's locale, the English catalog when there's none for their language.
+func (s AthleteSettings) locale() Locale {
+	language := strings.TrimSpace(s.Language)
+	if english, ok := nativeLanguageNames[strings.ToLower(language)]; ok {
+		language = english
+	}
+	for _, c := range catalogs {
+		if strings.EqualFold(c.language, language) {
+			return Locale{Units: s.Units, catalog: c}
+		}
+	}
+	return Locale{Units: s.Units, catalog: englishCatalog}
+}
+
+// translate returns the text in the athlete's language, as is when it isn't in the catalog.
+func (l Locale) translate(text string) string {
+	if strings.HasPrefix(text, "Treadmill ") {
+		if format, ok := l.catalog.names["Treadmill %s"]; ok {
+			return fmt.Sprintf(format, l.translate(strings.TrimPrefix(text, "Treadmill ")))
+		}
+	}
+	if translated, ok := l.catalog.names[text]; ok {
+		return translated
+	}
+	return text
+}
+
+// number formats a number with the given decimals and the language's decimal separator.
+func (l Locale) number(value float64, decimals int) string {
+	return strings.Replace(strconv.FormatFloat(value, 'f', decimals, 64), ".", l.catalog.decimal, 1)
+}
+
+// date formats a time with a Go layout, with the weekday and month names of the language.
+func (l Locale) date(t time.Time, layout string) string {
+	formatted := t.Format(layout)
+	if strings.Contains(layout, "Monday") {
+		formatted = strings.Replace(formatted, t.Weekday().String(), l.catalog.weekdays[t.Weekday()], 1)
+	}
+	if strings.Contains(layout, "January") {
+		formatted = strings.Replace(formatted, t.Month().String(), l.catalog.months[t.Month()-1], 1)
+	}
+	return formatted
+}
+
+// duration formats seconds as hours and minutes, e.g. "1h 30m".
+func (l Locale) duration(seconds int) string {
+	hours := seconds / 3600
+	minutes := (seconds % 3600) / 60
+	if hours > 0 {
+		return fmt.Sprintf("%dh %d%s", hours, minutes, l.catalog.minute)
+	}
+	return fmt.Sprintf("%d%s", minutes, l.catalog.minute)
+}
+
+// distance formats meters as kilometers or miles.
+func (l Locale) distance(meters float64) string {
+	if l.Units == unitsImperial {
+		return l.number(meters/metersPerMile, 2) + " mi"
+	}
+	return l.number(meters/1000, 2) + " km"
+}
+
+// elevation formats meters of elevation as meters or feet.
+func (l Locale) elevation(meters float64) string {
+	if l.Units == unitsImperial {
+		return l.number(meters*feetPerMeter, 0) + " ft"
+	}
+	return l.number(meters, 0) + " m"
+}
+
+// climbRate is how much an activity climbed per kilometer or mile.
+func (l Locale) climbRate(elevation float64, distance float64) string {
+	if l.Units == unitsImperial {
+		return l.number(elevation*feetPerMeter/(distance/metersPerMile), 0) + " ft/mi"
+	}
+	return l.number(elevation/(distance/1000), 0) + " m/km"
+}
+
+// pace converts a speed in meters per second into a running pace like "5:12 /km" or "8:22 /mi".
+func (l Locale) pace(metersPerSecond float64) string {
+	if l.Units == unitsImperial {
+		return formatTimePer(metersPerSecond, metersPerMile, "/mi")
+	}
+	return formatTimePer(metersPerSecond, 1000, "/km")
+}
+
+// swimPace formats a speed in meters per second as the time per 100 m or 100 yd.
+func (l Locale) swimPace(metersPerSecond float64) string {
+	if l.Units == unitsImperial {
+		return formatTimePer(metersPerSecond, 100*metersPerYard, "/100yd")
+	}
+	return formatTimePer(metersPerSecond, 100, "/100m")
+}
+
+// speed formats a speed in meters per second as km/h or mph.
+func (l Locale) speed(metersPerSecond float64) string {
+	if l.Units == unitsImperial {
+		return l.number(metersPerSecond*3600/metersPerMile, 1) + " mph"
+	}
+	return l.number(metersPerSecond*3.6, 1) + " km/h"
+}
+
+func (l Locale) temperature(celsius float64) string {
+	if l.Units == unitsImperial {
+		return l.number(celsius*9/5+32, 0) + "°F"
+	}
+	return l.number(celsius, 0) + "°C"
+}
+
+func formatTimePer(metersPerSecond float64, distance float64, label string) string {
+	if metersPerSecond <= 0 {
+		return "-"
+	}
+	seconds := int(math.Round(distance / metersPerSecond))
+	return fmt.Sprintf("%d:%02d %s", seconds/60, seconds%60, label)
+}
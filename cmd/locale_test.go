@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocaleTranslate(t *testing.T) {
+	tests := []struct {
+		language string
+		text     string
+		want     string
+	}{
+		{"English", "Long Run ☄️", "Long Run ☄️"},
+		{"English", "Treadmill Easy Flow 🌊🌊", "Treadmill Easy Flow 🌊🌊"},
+		{"Spanish", "Long Run ☄️", "Tirada larga ☄️"},
+		{"spanish", "Race Day 🏁", "Día de carrera 🏁"},
+		{"Español", "Recovery Spin 🌀", "Vuelta de recuperación 🌀"},
+		{"Deutsch", "Race Day 🏁", "Wettkampftag 🏁"},
+		{"German", "Treadmill Easy Flow 🌊🌊", "Laufband: Lockerer Lauf 🌊🌊"},
+		{"Italian", "Treadmill Morning Run", "Tapis roulant: Morning Run"},
+		{"French", "Parkrun", "Parkrun"},
+		{"Dutch", "weeks", "weken"},
+		{"Japanese", "Long Run ☄️", "Long Run ☄️"},
+		{"", "Long Run ☄️", "Long Run ☄️"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.language+"/"+tt.text, func(t *testing.T) {
+			loc := AthleteSettings{Language: tt.language, Units: unitsMetric}.locale()
+			if got := loc.translate(tt.text); got != tt.want {
+				t.Errorf("translate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocaleDate(t *testing.T) {
+	sunday := time.Date(2024, 3, 10, 7, 30, 0, 0, time.UTC)
+	monday := time.Date(2024, 5, 6, 18, 0, 0, 0, time.UTC)
+	tests := []struct {
+		language string
+		t        time.Time
+		layout   string
+		want     string
+	}{
+		{"English", sunday, "Monday 2 January 2006", "Sunday 10 March 2024"},
+		{"Spanish", sunday, "Monday 2 January 2006", "domingo 10 marzo 2024"},
+		{"German", sunday, "Monday 2 January 2006", "Sonntag 10 März 2024"},
+		{"French", sunday, "2 January", "10 mars"},
+		{"Dutch", sunday, "Monday", "zondag"},
+		{"Italian", monday, "Monday 2 January", "lunedì 6 maggio"},
+		{"Italian", monday, "January 2006", "maggio 2024"},
+		{"Italian", monday, "2006-01-02", "2024-05-06"},
+		{"Japanese", monday, "Monday 2 January", "Monday 6 May"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.language+"/"+tt.layout, func(t *testing.T) {
+			loc := AthleteSettings{Language: tt.language, Units: unitsMetric}.locale()
+			if got := loc.date(tt.t, tt.layout); got != tt.want {
+				t.Errorf("date() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
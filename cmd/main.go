@@ -6,6 +6,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-sql-driver/mysql"
 	_ "github.com/go-sql-driver/mysql"
@@ -17,114 +18,253 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-const (
-	redirectURI = "https://stratonova-l5snujqyaq-ew.a.run.app"
-	AthleteID   = 13560298
-)
+const AthleteID = 13560298
 
 type AccessTokenResponse struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
 	ExpiresAt    int64  `json:"expires_at"`
+	// Athlete only comes with the exchange of an authorization code
+	Athlete StravaAthlete `json:"athlete"`
+}
+
+type StravaAthlete struct {
+	ID        int    `json:"id"`
+	Firstname string `json:"firstname"`
 }
 
 type Workout struct {
-	ID                 int       `json:"id"`
-	Name               string    `json:"name"`
-	Description        string    `json:"description"`
-	SportType          string    `json:"sport_type"`
-	Distance           float64   `json:"distance"`
-	TotalElevationGain float64   `json:"total_elevation_gain"`
-	Duration           int       `json:"moving_time"`
-	Laps               []Lap     `json:"laps"`
-	StartLocation      []float64 `json:"start_latlng"`
-	AverageSpeed       float64   `json:"average_speed"`
-	Date               time.Time `json:"start_date"`
-	HeartRate          float64   `json:"average_heartrate"`
+	ID                 int          `json:"id"`
+	Name               string       `json:"name"`
+	Description        string       `json:"description"`
+	SportType          string       `json:"sport_type"`
+	Distance           float64      `json:"distance"`
+	TotalElevationGain float64      `json:"total_elevation_gain"`
+	Duration           int          `json:"moving_time"`
+	ElapsedTime        int          `json:"elapsed_time"`
+	Laps               []Lap        `json:"laps"`
+	SplitsMetric       []Split      `json:"splits_metric"`
+	SplitsStandard     []Split      `json:"splits_standard"`
+	BestEfforts        []BestEffort `json:"best_efforts"`
+	StartLocation      []float64    `json:"start_latlng"`
+	AverageSpeed       float64      `json:"average_speed"`
+	Date               time.Time    `json:"start_date"`
+	DateLocal          time.Time    `json:"start_date_local"`
+	Timezone           string       `json:"timezone"`
+	HeartRate          float64      `json:"average_heartrate"`
+	MaxHeartRate       float64      `json:"max_heartrate"`
+	AverageWatts       float64      `json:"average_watts"`
+	SufferScore        float64      `json:"suffer_score"`
+	Commute            bool         `json:"commute"`
+	Trainer            bool         `json:"trainer"`
+	Manual             bool         `json:"manual"`
+	Private            bool         `json:"private"`
+	Visibility         string       `json:"visibility"`
+	GearID             string       `json:"gear_id"`
+	// Weather isn't Strava's, Stratonova looks it up and stores it with the activity
+	Weather *Weather `json:"weather,omitempty"`
+	Athlete Athlete  `json:"athlete"`
+}
+
+type Athlete struct {
+	ID int `json:"id"`
 }
 
 type Lap struct {
+	Distance         float64 `json:"distance"`
+	MovingTime       int     `json:"moving_time"`
 	MaxSpeed         float64 `json:"max_speed"`
+	AverageWatts     float64 `json:"average_watts"`
 	AverageSpeed     float64 `json:"average_speed"`
 	AverageCadence   float64 `json:"average_cadence"`
 	AverageHeartRate float64 `json:"average_heartrate"`
 }
 
 func main() {
+	err := runCommand(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve starts the HTTP server along with the webhook workers and the recap scheduler.
+func serve(addr string) error {
 	// Define your handlers for different endpoints
 	http.HandleFunc("/", mainPageHandler)
 	http.HandleFunc("/exchange_token", exchangeTokenHandler)
-	http.HandleFunc("/update_workout", updateActivityHandler)
-	http.HandleFunc("/token", tokenHandler)
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/logout", logoutHandler)
+	http.HandleFunc("/disconnect", requireAuth(disconnectHandler))
 	http.HandleFunc("/webhook", webhookHandler)
+	http.HandleFunc("/update_workout", requireAuth(updateActivityHandler))
+	http.HandleFunc("/history", requireAuth(historyHandler))
+	http.HandleFunc("/undo", requireAuth(undoHandler))
+	http.HandleFunc("/recaps", requireAuth(recapsHandler))
+	http.HandleFunc("/recap", requireAuth(recapHandler))
+	http.HandleFunc("/backfill", requireAuth(backfillHandler))
+	http.HandleFunc("/settings", requireAuth(settingsPageHandler))
+	http.HandleFunc("/api/settings", requireAuth(settingsAPIHandler))
+	http.HandleFunc("/admin/subscriptions", requireAdmin(subscriptionsHandler))
+	// Live access tokens are only served while debugging
+	if config.Features.DebugToken {
+		http.HandleFunc("/token", requireAdmin(tokenHandler))
+	}
 
-	// Start the HTTP server
-	err := http.ListenAndServe(":8080", nil)
+	// The connection pool is shared by the handlers, the workers and the scheduler
+	db, err := database()
 	if err != nil {
-		fmt.Println("Error starting server:", err)
+		return fmt.Errorf("failed to connect to the database: %w", err)
+	}
+	// The webhook queue is created before serving, the webhook handler only inserts into it while Strava waits
+	err = createWebhookJobsTable(db)
+	if err != nil {
+		return fmt.Errorf("failed to create the webhook jobs table: %w", err)
+	}
+	err = createProcessedWebhookEventsTable(db)
+	if err != nil {
+		return fmt.Errorf("failed to create the processed webhook events table: %w", err)
+	}
+
+	// Process queued webhook events in the background
+	if config.Features.WebhookWorkers {
+		startWebhookWorkers(config.Server.WebhookWorkers)
+	}
+
+	// Post the weekly recaps when they are due
+	if config.Features.Scheduler {
+		startScheduler()
 	}
-}
 
-func mainPageHandler(w http.ResponseWriter, r *http.Request) {
-	stravaClientID := os.Getenv("STRAVA_CLIENT_ID")
-	// Step 1: Redirect the user to the Strava authorization page
-	authURL := fmt.Sprintf("https://www.strava.com/oauth/authorize?client_id=%s&response_type=code&scope=activity:read_all,activity:write&approval_prompt=force&redirect_uri=%s/exchange_token", stravaClientID, redirectURI)
-	fmt.Fprintf(w, "In case you do not have an access token, please visit the following URL to authorize the application: %s", authURL)
-	fmt.Fprintf(w, "otherwise, you can already start using the app by visiting the following URL: %s", "https://stratonova-l5snujqyaq-ew.a.run.app/update-activity?access_token={access token}")
+	// Start the HTTP server
+	err = http.ListenAndServe(addr, nil)
+	if err != nil {
+		return fmt.Errorf("error starting server: %w", err)
+	}
+	return nil
 }
 
+// tokenHandler serves an athlete's live access token, ?athlete_id= defaults to the main athlete.
 func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	athleteID, err := athleteIDParam(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid athlete id 🙃🙃🙃: %s", err), http.StatusBadRequest)
+		return
+	}
+
 	fmt.Println("Attempting to fetch token from cloud sql.")
-	token := getAccessToken()
+	token, err := getAccessTokenForAthlete(athleteID)
+	if err != nil {
+		fmt.Println("Failed to get the access token:", err)
+		http.Error(w, "Failed to get the access token", http.StatusInternalServerError)
+		return
+	}
 	fmt.Fprintf(w, "Successfuly got an access token : %s", token)
 }
 
 func exchangeTokenHandler(w http.ResponseWriter, r *http.Request) {
-	// Example of capturing the authorization code from a simulated redirect URI
-	authorizationCode := r.URL.Query().Get("code")
-	fmt.Println("Successfully got the auth code 🎉", authorizationCode)
+	query := r.URL.Query()
+	err := verifyOAuthState(r, query.Get("state"))
+	clearOAuthState(w)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid authorization request: %s", err), http.StatusForbidden)
+		return
+	}
+
+	// The athlete clicked Cancel on the Strava authorization page
+	if query.Get("error") == "access_denied" {
+		fmt.Fprint(w, "You didn't authorize Stratonova on Strava, no worries, you can come back anytime 👋")
+		return
+	}
+	if oauthError := query.Get("error"); oauthError != "" {
+		http.Error(w, fmt.Sprintf("Strava authorization failed: %s", oauthError), http.StatusBadRequest)
+		return
+	}
+
+	if missing := missingScopes(query.Get("scope")); len(missing) > 0 {
+		http.Error(w, fmt.Sprintf("Stratonova needs the %s permissions to work, please authorize again and keep them ticked", strings.Join(missing, " and ")), http.StatusForbidden)
+		return
+	}
+
+	authorizationCode := query.Get("code")
+	if authorizationCode == "" {
+		http.Error(w, "Missing authorization code", http.StatusBadRequest)
+		return
+	}
+	fmt.Println("Successfully got the auth code 🎉")
 
 	// Step 3: Exchange the authorization code for an access token
 	accessToken, err := getTokenFromStrava(authorizationCode, "")
 	if err != nil {
 		fmt.Println("Failed to exchange authorization code for access token:", err)
+		http.Error(w, "Failed to exchange the authorization code with Strava", http.StatusBadGateway)
+		return
+	}
+
+	// Step 4: Keep the tokens, so Stratonova can act on the athlete's behalf, and log the athlete in
+	err = storeTokens(accessToken.Athlete.ID, accessToken)
+	if err != nil {
+		fmt.Println("Failed to store the tokens:", err)
+		http.Error(w, "Failed to store the Strava tokens", http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(w, "Successfully got an accessToken 🎉%s", accessToken.AccessToken)
+	startSession(w, accessToken.Athlete.ID)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func updateActivityHandler(w http.ResponseWriter, r *http.Request) {
-	accessToken := getAccessToken()
+	athleteID, err := athleteIDParam(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid athlete id 🙃🙃🙃: %s", err), http.StatusBadRequest)
+		return
+	}
+	if !authorizeAthlete(w, r, athleteID) {
+		return
+	}
 
 	workoutID, err := strconv.Atoi(r.URL.Query().Get("workout_id"))
 	if err != nil {
-		fmt.Fprintf(w, "Invalid activity id 🙃🙃🙃: %s", err)
+		http.Error(w, fmt.Sprintf("Invalid activity id 🙃🙃🙃: %s", err), http.StatusBadRequest)
+		return
 	}
 
-	workouts, err := fetchWeekWorkouts(w, accessToken)
+	accessToken, err := getAccessTokenForAthlete(athleteID)
+	if err != nil {
+		fmt.Println("Failed to get the access token:", err)
+		http.Error(w, "Failed to get the Strava access token", http.StatusInternalServerError)
+		return
+	}
+	workouts, weekStart, weekEnd, err := fetchCurrentWeekWorkouts(athleteID, accessToken)
 	if err != nil {
 		fmt.Println("Failed to fetch workout details", err)
+		http.Error(w, "Failed to fetch the workouts of the week from Strava", http.StatusBadGateway)
 		return
 	}
 
-	prompt := buildPrompt(workouts)
-	fmt.Printf("Sending this prompt to chatgpt: %s\n", prompt)
-	summary, err := generateSummary(prompt)
+	settings := settingsOrDefault(athleteID)
+	// The digests of the prompt need the laps and splits of the detailed activities
+	workouts = fetchWorkoutDetails(settings.filterWorkouts(workouts), accessToken)
+	summary, _, err := generateWeeklySummary(workouts, weekStart, weekEnd, settings)
 	if err != nil {
 		fmt.Println("Error:", err)
+		http.Error(w, "Failed to generate the weekly summary", http.StatusBadGateway)
 		return
 	}
-	fmt.Printf("Summary from chatgpt: %s\n", summary)
 
-	err = updateWorkout(workoutID, summary, "Week Finisher ☄️", accessToken)
+	title := ""
+	if settings.Rename {
+		title = "Week Finisher ☄️"
+	}
+	err = updateWorkout(workoutID, summary, title, accessToken, sourceUpdateWorkout)
 	if err != nil {
 		fmt.Println("Failed to update workout description:", err)
+		http.Error(w, "Failed to update the workout description on Strava", http.StatusBadGateway)
 		return
 	}
-	fmt.Fprintf(w, "Workout description updated successfully!")
+	fmt.Fprintf(w, "Successfully fetched the %d workouts 🎉 Workout description updated successfully!", len(workouts))
 }
 
 func generateActivityName(workout Workout) string {
@@ -140,9 +280,9 @@ func generateActivityName(workout Workout) string {
 
 	// Get 2 laps from mid run and compare the pace, if its more than 2 mins, its def interval.
 	totalLaps := len(workout.Laps)
-	totalKms := convertMetersToKilometers(workout.Distance)
+	autoLaps := countAutoLaps(workout)
 
-	if hasMoreLapsThanKms(totalLaps, math.Ceil(totalKms)) {
+	if hasMoreLapsThanAutoLaps(totalLaps, math.Ceil(autoLaps)) {
 		// its either interval or threshold or progressive
 		if isIntervalTraining(workout) {
 			return "Interval training 💪🛤️"
@@ -153,13 +293,16 @@ func generateActivityName(workout Workout) string {
 	return "Easy Flow 🌊🌊"
 }
 
-func hasMoreLapsThanKms(totalLaps int, totalKms float64) bool {
-	return totalLaps > int(totalKms)
+func hasMoreLapsThanAutoLaps(totalLaps int, autoLaps float64) bool {
+	return totalLaps > int(autoLaps)
 }
 
 func isIntervalTraining(workout Workout) bool {
 	totalLaps := len(workout.Laps)
-	midLap := totalLaps / 2
+	if totalLaps < 2 {
+		return false
+	}
+	midLap := (totalLaps - 1) / 2
 	midLap1 := workout.Laps[midLap]
 	midLap2 := workout.Laps[midLap+1]
 	return isSpeedJump(midLap1, midLap2)
@@ -169,10 +312,14 @@ func isSpeedJump(lap1 Lap, lap2 Lap) bool {
 	return math.Abs(lap1.AverageSpeed-lap2.AverageSpeed) > 2
 }
 
-func convertMetersToKilometers(meters float64) float64 {
-	kilometers := meters / 1000.0
-	rounded := math.Round(kilometers*10) / 10.0
-	return rounded
+// countAutoLaps is how many laps the watch took on its own, every kilometer or, for athletes using miles, every mile.
+// The first lap tells which.
+func countAutoLaps(workout Workout) float64 {
+	lapDistance := 1000.0
+	if len(workout.Laps) > 0 && math.Abs(workout.Laps[0].Distance-metersPerMile) < 0.02*metersPerMile {
+		lapDistance = metersPerMile
+	}
+	return math.Round(workout.Distance/lapDistance*10) / 10.0
 }
 
 func prettyPrintJSON(jsonStr string) {
@@ -204,8 +351,8 @@ func getTokenFromStrava(code string, refreshToken string) (AccessTokenResponse,
 
 	// Set the request parameters
 	params := req.URL.Query()
-	params.Add("client_id", os.Getenv("STRAVA_CLIENT_ID"))
-	params.Add("client_secret", os.Getenv("STRAVA_CLIENT_SECRET"))
+	params.Add("client_id", config.Strava.ClientID)
+	params.Add("client_secret", config.Strava.ClientSecret)
 
 	if code != "" {
 		params.Add("code", code)
@@ -249,25 +396,31 @@ func getTokenFromStrava(code string, refreshToken string) (AccessTokenResponse,
 	return tokenResp, nil
 }
 
-// GetCurrentTimeEpoch returns the current time in Unix epoch seconds
-func getCurrentTimeEpoch() int64 {
-	return time.Now().Unix()
+// fetchWorkoutsBetween fetches the workouts that started between the after and before Unix epoch seconds.
+func fetchWorkoutsBetween(accessToken string, after int64, before int64) ([]Workout, error) {
+	var workouts []Workout
+	for page := 1; ; page++ {
+		pageWorkouts, err := fetchWorkoutsPage(accessToken, after, before, page)
+		if err != nil {
+			return []Workout{}, err
+		}
+		workouts = append(workouts, pageWorkouts...)
+		if len(pageWorkouts) < workoutsPerPage {
+			return workouts, nil
+		}
+	}
 }
 
-// GetLastWeekTimeEpoch returns the Unix epoch seconds for the same time last week
-func getLastWeekTimeEpoch() int64 {
-	// Subtract 7 days from the current time
-	lastWeek := time.Now().AddDate(0, 0, -7)
-	return lastWeek.Unix()
-}
+// workoutsPerPage is the largest page size the Strava activities endpoint allows.
+const workoutsPerPage = 200
 
-func fetchWeekWorkouts(w http.ResponseWriter, accessToken string) ([]Workout, error) {
-	//fmt.Printf("Fetching workout: %d with access token: %s", workoutID, accessToken)
+// fetchWorkoutsPage fetches one page of the workouts that started between the after and before Unix epoch seconds.
+func fetchWorkoutsPage(accessToken string, after int64, before int64, page int) ([]Workout, error) {
 	// Create a new HTTP client
 	client := http.Client{}
 
 	// Create a GET request to fetch the workout details
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://www.strava.com/api/v3/activities?before=%d&after=%d", getCurrentTimeEpoch(), getLastWeekTimeEpoch()), nil)
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://www.strava.com/api/v3/activities?before=%d&after=%d&per_page=%d&page=%d", before, after, workoutsPerPage, page), nil)
 	if err != nil {
 		return []Workout{}, err
 	}
@@ -281,6 +434,7 @@ func fetchWeekWorkouts(w http.ResponseWriter, accessToken string) ([]Workout, er
 		return []Workout{}, err
 	}
 	defer resp.Body.Close()
+	recordStravaRateLimit(resp.Header)
 
 	// Read the response body
 	body, err := io.ReadAll(resp.Body)
@@ -302,12 +456,101 @@ func fetchWeekWorkouts(w http.ResponseWriter, accessToken string) ([]Workout, er
 		return []Workout{}, err
 	}
 
-	_, _ = fmt.Fprintf(w, "Successfully fetched the %d workouts 🎉 ", len(workouts))
-
 	return workouts, nil
 }
 
-func updateWorkout(workoutID int, newDescription string, newName string, accessToken string) error {
+func fetchWorkout(workoutID int, accessToken string) (Workout, error) {
+	// Create a new HTTP client
+	client := http.Client{}
+
+	// Create a GET request to fetch the detailed workout
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://www.strava.com/api/v3/activities/%d", workoutID), nil)
+	if err != nil {
+		return Workout{}, err
+	}
+
+	// Set the access token in the request header
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	// Send the request
+	resp, err := client.Do(req)
+	if err != nil {
+		return Workout{}, err
+	}
+	defer resp.Body.Close()
+	recordStravaRateLimit(resp.Header)
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Workout{}, err
+	}
+
+	// Check the response status code
+	if resp.StatusCode != http.StatusOK {
+		return Workout{}, fmt.Errorf("request failed with status: %d, response: %s", resp.StatusCode, string(body))
+	}
+
+	var workout Workout
+	err = json.Unmarshal(body, &workout)
+	if err != nil {
+		return Workout{}, err
+	}
+
+	return workout, nil
+}
+
+// updateWorkout overwrites the name and description of a workout on Strava. The values being replaced are read and
+// recorded into the activity history first, so the change can always be undone.
+func updateWorkout(workoutID int, newDescription string, newName string, accessToken string, source string) error {
+	current, err := fetchWorkout(workoutID, accessToken)
+	if err != nil {
+		return fmt.Errorf("failed to fetch workout before updating it: %w", err)
+	}
+	// An empty name keeps the current one, for athletes who only want their descriptions written
+	if newName == "" {
+		newName = current.Name
+	}
+
+	// The snapshot is taken before Strava is asked, so what the activity looked like is never lost, even when the
+	// process dies halfway. It's applied once Strava took the change, and dropped when Strava refused it.
+	changeID, err := recordActivityChange(ActivityChange{
+		ActivityID:          workoutID,
+		AthleteID:           current.Athlete.ID,
+		PreviousName:        current.Name,
+		PreviousDescription: current.Description,
+		NewName:             newName,
+		NewDescription:      newDescription,
+		Source:              source,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record the change of the workout: %w", err)
+	}
+
+	err = putWorkout(workoutID, newDescription, newName, accessToken)
+	if err != nil {
+		if deleteErr := deleteActivityChange(changeID); deleteErr != nil {
+			fmt.Printf("Failed to drop the change %d Strava refused: %s\n", changeID, deleteErr)
+		}
+		return err
+	}
+
+	err = markActivityChangeApplied(changeID)
+	if err != nil {
+		fmt.Printf("Failed to mark the change %d of activity %d as applied: %s\n", changeID, workoutID, err)
+	}
+
+	// Strava's webhooks don't tell about new descriptions, the stored activity is updated here
+	err = updateStoredActivity(workoutID, func(w *Workout) {
+		w.Name, w.Description = newName, newDescription
+	})
+	if err != nil {
+		fmt.Printf("Failed to update the stored activity %d: %s\n", workoutID, err)
+	}
+	return nil
+}
+
+func putWorkout(workoutID int, newDescription string, newName string, accessToken string) error {
 	// Create a new HTTP client
 	client := http.Client{}
 
@@ -340,12 +583,12 @@ func updateWorkout(workoutID int, newDescription string, newName string, accessT
 		return err
 	}
 	defer resp.Body.Close()
+	recordStravaRateLimit(resp.Header)
 
 	// Check the response status code
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("request failed with status: %d", resp.StatusCode)
 	}
-
 	return nil
 }
 
@@ -368,8 +611,8 @@ type OpenAIResponse struct {
 }
 
 func generateSummary(prompt string) (string, error) {
-	apiKey := mustGetEnv("OPENAI_API_KEY")
-	url := "https://api.openai.com/v1/chat/completions"
+	apiKey := config.LLM.APIKey
+	url := config.LLM.BaseURL + "/chat/completions"
 
 	message := Message{
 		Content: prompt,
@@ -378,7 +621,7 @@ func generateSummary(prompt string) (string, error) {
 
 	messages := []Message{message}
 	requestBody, err := json.Marshal(OpenAIRequest{
-		Model:    "gpt-4-1106-preview",
+		Model:    config.LLM.Model,
 		Messages: messages,
 	})
 	if err != nil {
@@ -422,47 +665,47 @@ func generateSummary(prompt string) (string, error) {
 	return "", fmt.Errorf("No response received from ChatGPT")
 }
 
-func buildPrompt(workouts []Workout) string {
+// buildPrompt asks for a summary of the workouts of the week from weekStart (inclusive) to weekEnd (exclusive), both
+// in the athlete's timezone.
+func buildPrompt(workouts []Workout, records []PersonalRecord, comparisons map[int]EffortComparison, weekStart time.Time, weekEnd time.Time, settings AthleteSettings) string {
 	var sb strings.Builder
-	totalDistance := 0.0
+	loc := settings.locale()
 
-	sb.WriteString("You are my friendly running coach. Please generate a summary for my last week's (only starting from Monday)" +
-		" training log" +
-		"for another week in training for the Barcelona Marathon in March:\n\n")
+	sb.WriteString(fmt.Sprintf("%s Please generate a summary for my training week from %s to %s"+
+		" (only these days, all in my local time)"+
+		" for another week in training for the Barcelona Marathon in March:\n\n",
+		settings.coachRole(coachKind(workouts)), loc.date(weekStart, "Monday 2 January"), loc.date(weekEnd.AddDate(0, 0, -1), "Monday 2 January")))
 
+	// Distances only add up within a discipline, a km swum is no km run
+	var order []string
+	totals := map[string]float64{}
 	for _, w := range workouts {
-		distanceInKm := w.Distance / 1000
-		totalDistance += distanceInKm
-
-		sb.WriteString(fmt.Sprintf(
-			"- %s (%s): %.2f km in %s. %s\n",
-			w.Name,
-			w.Date.Format("Monday"),
-			w.Distance/1000,
-			humanReadableDuration(w.Duration),
-			w.Description,
-		))
-	}
-	totalDistanceRounded := math.Ceil(totalDistance)
+		d := discipline(w.SportType)
+		if _, ok := totals[d]; !ok {
+			order = append(order, d)
+		}
+		totals[d] += w.Distance
+	}
+	writeActivityLines(&sb, workouts, loc)
+	writeRecords(&sb, records, loc)
+	writeEffortComparisons(&sb, workouts, comparisons, loc)
+
+	var mileage []string
+	for _, d := range order {
+		if totals[d] > 0 {
+			mileage = append(mileage, fmt.Sprintf("%s %s", d, loc.distance(totals[d])))
+		}
+	}
 	sb.WriteString(fmt.Sprintf("\nInclude some friendly tips about last week, and what to "+
-		"watch out for next week. Total mileage in km last week: %d\n You can use emojis if it make sense."+
+		"watch out for next week. Total mileage last week: %s\n You can use emojis if it make sense."+
 		"Make the summary feel as human as possible."+
 		" Also it should be consise and not a lot of empty words."+
-		"Don't use markdown format, since it will not work when displayed.", int(totalDistanceRounded)))
+		"Don't use markdown format, since it will not work when displayed."+weatherInstructions(workouts)+settings.writingInstructions(),
+		strings.Join(mileage, ", ")))
 
 	return sb.String()
 }
 
-// humanReadableDuration converts duration from seconds to a human-friendly format
-func humanReadableDuration(seconds int) string {
-	hours := seconds / 3600
-	minutes := (seconds % 3600) / 60
-	if hours > 0 {
-		return fmt.Sprintf("%dh %dm", hours, minutes)
-	}
-	return fmt.Sprintf("%dm", minutes)
-}
-
 func openAI() {
 	const prompt = `
 	Based on the JSON I provied earlier, can you please generate a summary in a story-telling exciting way rather
@@ -490,85 +733,104 @@ type RefreshToken struct {
 	RefreshToken string
 }
 
-func getAccessToken() string {
-	// Open a connection to the database
-	db, err := connectWithConnector()
+// errNoTokens is returned for athletes who never authorized Stratonova, or disconnected it.
+var errNoTokens = errors.New("no Strava tokens stored")
+
+// getAccessTokenForAthlete returns a valid access token of the athlete, refreshing it on Strava when it expired.
+func getAccessTokenForAthlete(athleteID int) (string, error) {
+	db, err := database()
 	if err != nil {
-		log.Fatal(err)
-		fmt.Println("failed to open con!", err)
+		return "", err
 	}
-	defer db.Close()
 
-	// Test the connection
-	err = db.Ping()
+	accessToken, err := getAccessTokenFromSQL(db, athleteID)
 	if err != nil {
-		log.Fatal(err)
-		fmt.Println("failed to ping!", err)
+		return "", err
 	}
-
-	fmt.Println("Connected to the database!")
-
-	accessToken := getAccessTokenFromSQL(db, AthleteID)
 	if accessToken.ExpiresAt.Before(time.Now()) {
-		refreshToken := getRefreshTokenFromSQL(db, AthleteID)
+		refreshToken, err := getRefreshTokenFromSQL(db, athleteID)
+		if err != nil {
+			return "", err
+		}
 		newAccessToken, err := getTokenFromStrava("", refreshToken.RefreshToken)
 		if err != nil {
-			log.Fatalf("Failed to refresh the token on strava. Err: %s", err)
+			return "", fmt.Errorf("failed to refresh the token of athlete %d on strava: %w", athleteID, err)
+		}
+		err = updateTokens(db, athleteID, newAccessToken)
+		if err != nil {
+			return "", err
 		}
-		updateTokens(db, AthleteID, newAccessToken)
+		accessToken.Token = newAccessToken.AccessToken
 	}
 
-	fmt.Printf("Got Access Token! : AthleteId=%d, Token=%s\n", accessToken.AthleteId, accessToken.Token)
+	fmt.Printf("Got the access token of athlete %d\n", accessToken.AthleteId)
 
-	return accessToken.Token
+	return accessToken.Token, nil
 }
 
-func getAccessTokenFromSQL(db *sql.DB, athleteID int) AccessToken {
+func getAccessTokenFromSQL(db *sql.DB, athleteID int) (AccessToken, error) {
 	var accessToken AccessToken
-	query := fmt.Sprintf("SELECT *  FROM strava_access_tokens WHERE athlete_id=%d;", athleteID)
-	err := db.QueryRow(query).Scan(&accessToken.AthleteId, &accessToken.Token, &accessToken.ExpiresAt)
-	if err != nil {
-		log.Fatal(err)
+	err := db.QueryRow("SELECT athlete_id, token, expires_at FROM strava_access_tokens WHERE athlete_id=?;", athleteID).
+		Scan(&accessToken.AthleteId, &accessToken.Token, &accessToken.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return AccessToken{}, fmt.Errorf("athlete %d: %w", athleteID, errNoTokens)
 	}
-	return accessToken
+	return accessToken, err
 }
 
-func getRefreshTokenFromSQL(db *sql.DB, athleteID int) RefreshToken {
+func getRefreshTokenFromSQL(db *sql.DB, athleteID int) (RefreshToken, error) {
 	var refreshToken RefreshToken
-	query := fmt.Sprintf("SELECT *  FROM strava_refresh_tokens WHERE athlete_id=%d;", athleteID)
-	err := db.QueryRow(query).Scan(&refreshToken.AthleteId, &refreshToken.RefreshToken)
-	if err != nil {
-		log.Fatal(err)
+	err := db.QueryRow("SELECT athlete_id, refresh_token FROM strava_refresh_tokens WHERE athlete_id=?;", athleteID).
+		Scan(&refreshToken.AthleteId, &refreshToken.RefreshToken)
+	if err == sql.ErrNoRows {
+		return RefreshToken{}, fmt.Errorf("athlete %d: %w", athleteID, errNoTokens)
 	}
-	return refreshToken
+	return refreshToken, err
 }
 
-func updateTokens(db *sql.DB, athleteID int, token AccessTokenResponse) {
-	// Prepare the SQL statement
-	updateAccessTokenStmt, err := db.Prepare("UPDATE strava_access_tokens SET token=?, expires_at=? WHERE athlete_id=?;")
+func updateTokens(db *sql.DB, athleteID int, token AccessTokenResponse) error {
+	_, err := db.Exec("UPDATE strava_access_tokens SET token=?, expires_at=? WHERE athlete_id=?;",
+		token.AccessToken, time.Unix(token.ExpiresAt, 0), athleteID)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer updateAccessTokenStmt.Close()
+	_, err = db.Exec("UPDATE strava_refresh_tokens SET refresh_token=? WHERE athlete_id=?;", token.RefreshToken, athleteID)
+	return err
+}
 
-	// Execute the SQL statement with the time value as the parameter
-	_, err = updateAccessTokenStmt.Exec(token.AccessToken, time.Unix(token.ExpiresAt, 0), athleteID)
-	if err != nil {
-		log.Fatal(err)
+// sharedDB is the connection pool to the Cloud SQL instance, shared by the whole process. It is opened by the first
+// call to database, and never closed.
+var (
+	sharedDB   *sql.DB
+	sharedDBMu sync.Mutex
+)
+
+// database returns the shared connection pool, connecting to the Cloud SQL instance on the first call. A failed
+// connection is tried again on the next call.
+func database() (*sql.DB, error) {
+	sharedDBMu.Lock()
+	defer sharedDBMu.Unlock()
+	if sharedDB != nil {
+		return sharedDB, nil
 	}
 
-	// Prepare the SQL statement
-	updateRefreshTokenStmt, err := db.Prepare("UPDATE strava_refresh_tokens SET refresh_token=? WHERE athlete_id=?;")
+	db, err := connectWithConnector()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer updateRefreshTokenStmt.Close()
+	sharedDB = db
+	return sharedDB, nil
+}
 
-	// Execute the SQL statement with the time value as the parameter
-	_, err = updateRefreshTokenStmt.Exec(token.RefreshToken, athleteID)
-	if err != nil {
-		log.Fatal(err)
+// addColumnIfMissing adds a column to a table created by an earlier version of Stratonova.
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema=DATABASE() AND table_name=? AND column_name=?;", table, column).Scan(&count)
+	if err != nil || count > 0 {
+		return err
 	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition))
+	return err
 }
 
 func connectWithConnector() (*sql.DB, error) {
@@ -577,11 +839,10 @@ func connectWithConnector() (*sql.DB, error) {
 	// Cloud Secret Manager (https://cloud.google.com/secret-manager) to help
 	// keep passwords and other secrets safe.
 	var (
-		dbUser                 = mustGetEnv("DB_USER")                  // e.g. 'my-db-user'
-		dbPwd                  = mustGetEnv("DB_PASS")                  // e.g. 'my-db-password'
-		dbName                 = mustGetEnv("DB_NAME")                  // e.g. 'my-database'
-		instanceConnectionName = mustGetEnv("INSTANCE_CONNECTION_NAME") // e.g. 'project:region:instance'
-		usePrivate             = os.Getenv("PRIVATE_IP")
+		dbUser                 = config.Database.User                   // e.g. 'my-db-user'
+		dbPwd                  = config.Database.Password               // e.g. 'my-db-password'
+		dbName                 = config.Database.Name                   // e.g. 'my-database'
+		instanceConnectionName = config.Database.InstanceConnectionName // e.g. 'project:region:instance'
 	)
 
 	d, err := cloudsqlconn.NewDialer(context.Background())
@@ -589,7 +850,7 @@ func connectWithConnector() (*sql.DB, error) {
 		return nil, fmt.Errorf("cloudsqlconn.NewDialer: %w", err)
 	}
 	var opts []cloudsqlconn.DialOption
-	if usePrivate != "" {
+	if config.Database.PrivateIP {
 		opts = append(opts, cloudsqlconn.WithPrivateIP())
 	}
 	mysql.RegisterDialContext("cloudsqlconn",
@@ -602,29 +863,32 @@ func connectWithConnector() (*sql.DB, error) {
 
 	dbPool, err := sql.Open("mysql", dbURI)
 	if err != nil {
+		d.Close()
 		return nil, fmt.Errorf("sql.Open: %w", err)
 	}
-	return dbPool, nil
-}
-
-func mustGetEnv(k string) string {
-	v := os.Getenv(k)
-	if v == "" {
-		log.Fatalf("Fatal Error in connect_connector.go: %s environment variable not set.", k)
+	err = dbPool.Ping()
+	if err != nil {
+		dbPool.Close()
+		d.Close()
+		return nil, fmt.Errorf("db.Ping: %w", err)
 	}
-	return v
+	return dbPool, nil
 }
 
 type WebhookEvent struct {
-	ObjectType string `json:"object_type"`
-	ObjectId   int    `json:"object_id"`
-	AspectType string `json:"aspect_type"`
+	ObjectType     string            `json:"object_type"`
+	ObjectId       int               `json:"object_id"`
+	AspectType     string            `json:"aspect_type"`
+	OwnerId        int               `json:"owner_id"`
+	SubscriptionId int               `json:"subscription_id"`
+	EventTime      int64             `json:"event_time"`
+	Updates        map[string]string `json:"updates"`
 }
 
 func webhookHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		verifyToken := mustGetEnv("STRAVA_VERIFY_TOKEN")
+		verifyToken := config.Strava.VerifyToken
 		// Parses the query params
 		mode := r.URL.Query().Get("hub.mode")
 		token := r.URL.Query().Get("hub.verify_token")
@@ -658,8 +922,6 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 
 		// Close the request body to prevent resource leaks
 		defer r.Body.Close()
-		fmt.Printf("body: %s", r.Body)
-		fmt.Printf("parsing")
 		// Parse the JSON data into a struct
 		var event WebhookEvent
 		err = json.Unmarshal(body, &event)
@@ -668,51 +930,55 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if event.ObjectType == "activity" && event.AspectType == "create" && isTodaySunday() {
-			accessToken := getAccessToken()
-
-			workouts, err := fetchWeekWorkouts(w, accessToken)
-			prompt := buildPrompt(workouts)
-			fmt.Printf("Sending this prompt to chatgpt: %s\n", prompt)
-
-			summary, err := generateSummary(prompt)
-			if err != nil {
-				fmt.Println("Error:", err)
-				return
-			}
-
-			fmt.Printf("Summary from chatgpt: %s\n", summary)
-
-			currentDate := time.Now()                                             // get current date
-			marathonDate := time.Date(2024, time.March, 10, 0, 0, 0, 0, time.UTC) // set the marathon date
-			weeksUntilMarathon := int(math.Ceil(marathonDate.Sub(currentDate).Hours() / 24 / 7))
-			weekLabel := "weeks"
-			if weeksUntilMarathon == 1 {
-				weekLabel = "week"
-			}
-
-			err = updateWorkout(event.ObjectId, summary, fmt.Sprintf("T-%d %s: Road to BCN\n\n", weeksUntilMarathon, weekLabel), accessToken)
-			if err != nil {
-				fmt.Println("Failed to update workout description:", err)
-				return
-			}
-
-			fmt.Println("Workout description updated successfully!")
+		// Strava considers any non-200 answer a failed delivery, so events we don't act on are acknowledged too.
+		if !isWebhookEventHandled(event) {
+			fmt.Printf("Ignoring %s %s webhook event for %d\n", event.ObjectType, event.AspectType, event.ObjectId)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
 
-		} else {
-			http.Error(w, "Webhook event not supported yet.", http.StatusBadRequest)
+		// Strava expects an acknowledgement within 2 seconds, so the actual work is left to the job workers.
+		enqueued, err := enqueueWebhookJob(event, body)
+		if err != nil {
+			fmt.Println("Failed to enqueue webhook event:", err)
+			http.Error(w, "Failed to enqueue webhook event", http.StatusInternalServerError)
 			return
 		}
+		if !enqueued {
+			fmt.Printf("Skipping duplicate webhook event for %s %d\n", event.ObjectType, event.ObjectId)
+		}
+		w.WriteHeader(http.StatusOK)
 	default:
 		http.Error(w, "Sorry, only GET and POST are supported", http.StatusNotFound)
 	}
 }
 
-// isTodaySunday checks if today is Monday.
-func isTodaySunday() bool {
-	// Get the current day of the week.
-	today := time.Now().Weekday()
+// generateWeeklySummary asks ChatGPT for a summary of the week's workouts and comes up with the title it is posted
+// under.
+func generateWeeklySummary(workouts []Workout, weekStart time.Time, weekEnd time.Time, settings AthleteSettings) (string, string, error) {
+	workouts = settings.filterWorkouts(workouts)
+	records := weekRecords(settings.AthleteID, weekStart, weekEnd)
+	comparisons := weekComparisons(workouts)
+	prompt := buildPrompt(workouts, records, comparisons, weekStart, weekEnd, settings)
+	if isMultisport(workouts, settings.Plan) {
+		prompt = buildMultisportPrompt(workouts, records, comparisons, weekStart, weekEnd, settings)
+	}
+	fmt.Printf("Sending this prompt to chatgpt: %s\n", prompt)
+
+	summary, err := generateSummary(prompt)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate summary: %w", err)
+	}
+
+	fmt.Printf("Summary from chatgpt: %s\n", summary)
+
+	currentDate := time.Now()                                             // get current date
+	marathonDate := time.Date(2024, time.March, 10, 0, 0, 0, 0, time.UTC) // set the marathon date
+	weeksUntilMarathon := int(math.Ceil(marathonDate.Sub(currentDate).Hours() / 24 / 7))
+	weekLabel := settings.locale().translate("weeks")
+	if weeksUntilMarathon == 1 {
+		weekLabel = settings.locale().translate("week")
+	}
 
-	// Check if today is Monday.
-	return today == time.Sunday
+	return summary, fmt.Sprintf("T-%d %s: Road to BCN\n\n", weeksUntilMarathon, weekLabel), nil
 }
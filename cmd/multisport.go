@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// planDisciplines are the disciplines a weekly plan and the multisport breakdown are made of, in the order of a
+// triathlon.
+var planDisciplines = []string{disciplineSwim, disciplineRide, disciplineRun, disciplineStrength}
+
+const (
+	// brickMaxTransition is the longest gap between the end of a ride and the start of a run that still makes a brick.
+	brickMaxTransition = 30 * time.Minute
+	// defaultLoadPerHour estimates the load of a workout Strava has no relative effort for, as a moderate hour.
+	defaultLoadPerHour = 50
+	maxPlanHours       = 40
+)
+
+// DisciplineSummary is what an athlete did in one discipline over a week.
+type DisciplineSummary struct {
+	Discipline string
+	Activities int
+	Duration   int
+	Distance   float64
+	Load       float64
+}
+
+// Brick is a ride followed right away by a run, the staple of triathlon training.
+type Brick struct {
+	Ride       Workout
+	Run        Workout
+	Transition time.Duration
+}
+
+// workoutLoad is the training load of a workout: Strava's relative effort when it has one, otherwise an estimate
+// from the duration.
+func workoutLoad(w Workout) float64 {
+	if w.SufferScore > 0 {
+		return w.SufferScore
+	}
+	return float64(w.Duration) / 3600 * defaultLoadPerHour
+}
+
+// breakdownByDiscipline sums up the workouts per discipline, in the order of planDisciplines followed by the others.
+func breakdownByDiscipline(workouts []Workout) []DisciplineSummary {
+	byDiscipline := map[string]*DisciplineSummary{}
+	for _, w := range workouts {
+		d := discipline(w.SportType)
+		summary, ok := byDiscipline[d]
+		if !ok {
+			summary = &DisciplineSummary{Discipline: d}
+			byDiscipline[d] = summary
+		}
+		summary.Activities++
+		summary.Duration += w.Duration
+		summary.Distance += w.Distance
+		summary.Load += workoutLoad(w)
+	}
+
+	var breakdown []DisciplineSummary
+	order := append(append([]string(nil), planDisciplines...), disciplineHike, disciplineOther)
+	for _, d := range order {
+		if summary, ok := byDiscipline[d]; ok {
+			breakdown = append(breakdown, *summary)
+		}
+	}
+	return breakdown
+}
+
+// detectBricks finds the runs started within brickMaxTransition of the end of a ride.
+func detectBricks(workouts []Workout) []Brick {
+	sorted := append([]Workout(nil), workouts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Date.Before(sorted[j].Date) })
+
+	var bricks []Brick
+	for i, ride := range sorted {
+		if discipline(ride.SportType) != disciplineRide {
+			continue
+		}
+		elapsed := ride.ElapsedTime
+		if elapsed == 0 {
+			elapsed = ride.Duration
+		}
+		rideEnd := ride.Date.Add(time.Duration(elapsed) * time.Second)
+
+		for _, run := range sorted[i+1:] {
+			transition := run.Date.Sub(rideEnd)
+			if transition > brickMaxTransition {
+				break
+			}
+			if discipline(run.SportType) == disciplineRun && transition >= -time.Minute {
+				bricks = append(bricks, Brick{Ride: ride, Run: run, Transition: transition})
+				break
+			}
+		}
+	}
+	return bricks
+}
+
+// isMultisport tells whether the week calls for the discipline breakdown: the athlete trained at least two of swim,
+// bike and run, or plans to.
+func isMultisport(workouts []Workout, plan map[string]float64) bool {
+	seen := map[string]bool{}
+	for _, w := range workouts {
+		seen[discipline(w.SportType)] = true
+	}
+	for d, hours := range plan {
+		if hours > 0 {
+			seen[d] = true
+		}
+	}
+	count := 0
+	for _, d := range []string{disciplineSwim, disciplineRide, disciplineRun} {
+		if seen[d] {
+			count++
+		}
+	}
+	return count >= 2
+}
+
+// buildMultisportPrompt asks for a weekly summary broken down by discipline, with the bricks of the week and how
+// the time spent in each discipline compares with the athlete's plan.
+func buildMultisportPrompt(workouts []Workout, records []PersonalRecord, comparisons map[int]EffortComparison, weekStart time.Time, weekEnd time.Time, settings AthleteSettings) string {
+	var sb strings.Builder
+	loc := settings.locale()
+
+	sb.WriteString(fmt.Sprintf("%s Please generate a summary for my training week from %s to %s"+
+		" (only these days, all in my local time). I train several disciplines, look at how they fit together:\n\n",
+		settings.coachRole(coachKind(workouts)), loc.date(weekStart, "Monday 2 January"), loc.date(weekEnd.AddDate(0, 0, -1), "Monday 2 January")))
+
+	writeActivityLines(&sb, workouts, loc)
+
+	breakdown := breakdownByDiscipline(workouts)
+	totalDuration, totalLoad := 0, 0.0
+	for _, d := range breakdown {
+		totalDuration += d.Duration
+		totalLoad += d.Load
+	}
+
+	sb.WriteString("\nBy discipline:\n")
+	for _, d := range breakdown {
+		line := fmt.Sprintf("- %s: %d sessions, %s", d.Discipline, d.Activities, loc.duration(d.Duration))
+		if d.Distance > 0 && d.Discipline != disciplineStrength {
+			line += ", " + loc.distance(d.Distance)
+		}
+		line += fmt.Sprintf(", load %.0f", d.Load)
+		if totalDuration > 0 {
+			line += fmt.Sprintf(", %.0f%% of the time", float64(d.Duration)/float64(totalDuration)*100)
+		}
+		if hours, ok := settings.Plan[d.Discipline]; ok && hours > 0 {
+			planned := hours * 3600
+			line += fmt.Sprintf(", planned %s (%s)", loc.duration(int(planned)), percentChange(float64(d.Duration), planned))
+		}
+		sb.WriteString(line + "\n")
+	}
+	for _, d := range planDisciplines {
+		hours := settings.Plan[d]
+		if hours > 0 && !hasDiscipline(breakdown, d) {
+			sb.WriteString(fmt.Sprintf("- %s: nothing, planned %s\n", d, loc.duration(int(hours*3600))))
+		}
+	}
+	sb.WriteString(fmt.Sprintf("Total: %s, load %.0f\n", loc.duration(totalDuration), totalLoad))
+
+	if bricks := detectBricks(workouts); len(bricks) > 0 {
+		sb.WriteString("\nBricks:\n")
+		for _, b := range bricks {
+			sb.WriteString(fmt.Sprintf("- %s: %s ride, then a %s run %s later\n",
+				loc.date(localStartDate(b.Ride), "Monday"), loc.distance(b.Ride.Distance),
+				loc.distance(b.Run.Distance), loc.duration(int(math.Max(0, b.Transition.Seconds())))))
+		}
+	}
+
+	writeRecords(&sb, records, loc)
+	writeEffortComparisons(&sb, workouts, comparisons, loc)
+
+	sb.WriteString("\nTell me how balanced my disciplines were")
+	if len(settings.Plan) > 0 {
+		sb.WriteString(" compared with my plan")
+	}
+	sb.WriteString(", how the load was spread over the week, and what to watch out for next week." +
+		" You can use emojis if it make sense. Make the summary feel as human as possible." +
+		" Also it should be consise and not a lot of empty words." +
+		"Don't use markdown format, since it will not work when displayed." + weatherInstructions(workouts) + settings.writingInstructions())
+
+	return sb.String()
+}
+
+func hasDiscipline(breakdown []DisciplineSummary, d string) bool {
+	for _, summary := range breakdown {
+		if summary.Discipline == d {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePlan parses a weekly plan written as "swim=3,ride=6,run=4", in hours per discipline.
+func parsePlan(value string) (map[string]float64, error) {
+	plan := map[string]float64{}
+	for _, item := range splitList(value) {
+		d, hours, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid plan %q, expected discipline=hours", item)
+		}
+		h, err := strconv.ParseFloat(strings.TrimSpace(hours), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hours %q for %s", hours, d)
+		}
+		plan[strings.TrimSpace(d)] = h
+	}
+	return plan, nil
+}
+
+// formatPlan writes a plan the way parsePlan reads it.
+func formatPlan(plan map[string]float64) string {
+	var items []string
+	for _, d := range planDisciplines {
+		if hours, ok := plan[d]; ok {
+			items = append(items, fmt.Sprintf("%s=%s", d, strconv.FormatFloat(hours, 'f', -1, 64)))
+		}
+	}
+	return strings.Join(items, ",")
+}
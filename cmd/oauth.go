@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// oauthStateTTL is how long an athlete has to approve Stratonova on Strava.
+	oauthStateTTL    = 10 * time.Minute
+	oauthStateCookie = "stratonova_oauth_state"
+)
+
+// requiredScopes are the Strava scopes Stratonova can't work without: reading every activity, and writing the names
+// and descriptions.
+var requiredScopes = []string{"activity:read_all", "activity:write"}
+
+// stravaAuthorizeURL returns the Strava page asking the athlete to authorize Stratonova.
+func stravaAuthorizeURL(state string) string {
+	params := url.Values{}
+	params.Set("client_id", config.Strava.ClientID)
+	params.Set("response_type", "code")
+	params.Set("scope", strings.Join(requiredScopes, ","))
+	params.Set("approval_prompt", "force")
+	params.Set("redirect_uri", config.Server.PublicBaseURL+"/exchange_token")
+	params.Set("state", state)
+	return "https://www.strava.com/oauth/authorize?" + params.Encode()
+}
+
+// newOAuthState returns a signed state value expiring after oauthStateTTL, "{expiry}.{nonce}.{signature}". The
+// nonce is also set in a cookie, so the state is only accepted back from the browser that started the flow.
+func newOAuthState(w http.ResponseWriter) (string, error) {
+	random := make([]byte, 16)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(random)
+	expiry := time.Now().Add(oauthStateTTL)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    nonce,
+		Path:     "/exchange_token",
+		Expires:  expiry,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.Server.PublicBaseURL, "https://"),
+		// Lax, since Strava redirects back with a top level navigation
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	payload := fmt.Sprintf("%d.%s", expiry.Unix(), nonce)
+	return payload + "." + sign("oauth-state:"+payload), nil
+}
+
+// verifyOAuthState checks the state Strava redirected back with was issued by Stratonova to this browser and hasn't
+// expired.
+func verifyOAuthState(r *http.Request, state string) error {
+	parts := strings.Split(state, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed state")
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(sign("oauth-state:"+payload))) {
+		return fmt.Errorf("state has an invalid signature")
+	}
+
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed state expiry")
+	}
+	if time.Now().Unix() > expiry {
+		return fmt.Errorf("state has expired, please authorize again")
+	}
+
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || !hmac.Equal([]byte(cookie.Value), []byte(parts[1])) {
+		return fmt.Errorf("state was issued to another browser")
+	}
+	return nil
+}
+
+// missingScopes returns the required scopes the athlete didn't grant. Strava lets athletes untick scopes on the
+// authorization page, and reports the ones granted as a comma separated scope parameter.
+func missingScopes(granted string) []string {
+	grantedScopes := map[string]bool{}
+	for _, scope := range strings.Split(granted, ",") {
+		grantedScopes[strings.TrimSpace(scope)] = true
+	}
+
+	var missing []string
+	for _, scope := range requiredScopes {
+		if !grantedScopes[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+// clearOAuthState removes the state cookie once the flow is over, so the state can't be used twice.
+func clearOAuthState(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/exchange_token", MaxAge: -1})
+}
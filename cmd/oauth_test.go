@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedOAuthState returns a state for the nonce expiring at the given time, signed with the current secret.
+func signedOAuthState(expiry time.Time, nonce string) string {
+	payload := fmt.Sprintf("%d.%s", expiry.Unix(), nonce)
+	return payload + "." + sign("oauth-state:"+payload)
+}
+
+func TestVerifyOAuthState(t *testing.T) {
+	useAuthConfig(t, "admin-key", "signing-secret")
+
+	w := httptest.NewRecorder()
+	issued, err := newOAuthState(w)
+	if err != nil {
+		t.Fatalf("newOAuthState() error = %v", err)
+	}
+	cookie := w.Result().Cookies()[0]
+	parts := strings.Split(issued, ".")
+
+	inAMinute := time.Now().Add(time.Minute)
+	useAuthConfig(t, "admin-key", "another-secret")
+	otherSecretState := signedOAuthState(inAMinute, cookie.Value)
+	useAuthConfig(t, "admin-key", "signing-secret")
+
+	tests := []struct {
+		name    string
+		state   string
+		cookie  *http.Cookie
+		wantErr bool
+	}{
+		{"issued state", issued, cookie, false},
+		{"signed state", signedOAuthState(inAMinute, cookie.Value), cookie, false},
+		{"expired state", signedOAuthState(time.Now().Add(-time.Minute), cookie.Value), cookie, true},
+		{"tampered expiry", fmt.Sprintf("%d.%s.%s", time.Now().Add(time.Hour).Unix(), parts[1], parts[2]), cookie, true},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + sign("oauth-state:another"), cookie, true},
+		{"signed with another secret", otherSecretState, cookie, true},
+		{"without the cookie", issued, nil, true},
+		{"cookie of another browser", issued, &http.Cookie{Name: oauthStateCookie, Value: "another-nonce"}, true},
+		{"malformed", "not-a-state", cookie, true},
+		{"empty", "", cookie, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/exchange_token", nil)
+			if tt.cookie != nil {
+				r.AddCookie(tt.cookie)
+			}
+			err := verifyOAuthState(r, tt.state)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyOAuthState() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMissingScopes(t *testing.T) {
+	tests := []struct {
+		granted string
+		want    []string
+	}{
+		{"read,activity:write,activity:read_all", nil},
+		{"activity:read_all, activity:write", nil},
+		{"read,activity:read_all", []string{"activity:write"}},
+		{"read,activity:read,activity:write", []string{"activity:read_all"}},
+		{"read", []string{"activity:read_all", "activity:write"}},
+		{"", []string{"activity:read_all", "activity:write"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.granted, func(t *testing.T) {
+			if got := missingScopes(tt.granted); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missingScopes(%q) = %q, want %q", tt.granted, got, tt.want)
+			}
+		})
+	}
+}
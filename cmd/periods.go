@@ -0,0 +1,431 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Periods a recap can cover. A block is a training block with explicit start and end dates.
+const (
+	periodWeek    = "week"
+	periodMonth   = "month"
+	periodQuarter = "quarter"
+	periodYear    = "year"
+	periodBlock   = "block"
+)
+
+// fastestRunMinDistance keeps short strides and warm-ups out of the fastest effort of a period.
+const fastestRunMinDistance = 5000
+
+// PeriodStats aggregates the workouts of a recap period.
+type PeriodStats struct {
+	Start       time.Time
+	End         time.Time
+	Activities  int
+	Runs        int
+	Distance    float64
+	Duration    int
+	Elevation   float64
+	LongestRun  *Workout
+	FastestRun  *Workout
+	ActiveDays  int
+	ActiveWeeks int
+	Weeks       int
+	// Coach is the kind of coach the workouts call for, see coachKind
+	Coach string
+	// DisciplineDistances splits the distance by discipline, for athletes training more than running
+	DisciplineDistances map[string]float64
+}
+
+func isRecapPeriod(period string) bool {
+	switch period {
+	case periodWeek, periodMonth, periodQuarter, periodYear, periodBlock:
+		return true
+	}
+	return false
+}
+
+// periodBounds returns the start (inclusive) and end (exclusive) of the week, month, quarter or year t falls in.
+func periodBounds(period string, t time.Time, weekStart time.Weekday) (time.Time, time.Time, error) {
+	switch period {
+	case periodWeek:
+		start, end := calendarWeek(t, weekStart)
+		return start, end, nil
+	case periodMonth:
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 1, 0), nil
+	case periodQuarter:
+		start := time.Date(t.Year(), (t.Month()-1)/3*3+1, 1, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 3, 0), nil
+	case periodYear:
+		start := time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(1, 0, 0), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("period %q has no calendar bounds", period)
+}
+
+// previousPeriod returns the period right before the given one, of the same kind and length.
+func previousPeriod(period string, start time.Time, end time.Time) (time.Time, time.Time) {
+	switch period {
+	case periodWeek:
+		return start.AddDate(0, 0, -7), start
+	case periodMonth:
+		return start.AddDate(0, -1, 0), start
+	case periodQuarter:
+		return start.AddDate(0, -3, 0), start
+	case periodYear:
+		return start.AddDate(-1, 0, 0), start
+	}
+	days := int(math.Round(end.Sub(start).Hours() / 24))
+	return start.AddDate(0, 0, -days), start
+}
+
+func describePeriod(period string, start time.Time, end time.Time, loc Locale) string {
+	switch period {
+	case periodMonth:
+		return loc.date(start, "January 2006")
+	case periodQuarter:
+		return fmt.Sprintf("Q%d %d", (int(start.Month())-1)/3+1, start.Year())
+	case periodYear:
+		return start.Format("2006")
+	}
+	return fmt.Sprintf("%s to %s", loc.date(start, "2 January 2006"), loc.date(end.AddDate(0, 0, -1), "2 January 2006"))
+}
+
+func computePeriodStats(workouts []Workout, start time.Time, end time.Time) PeriodStats {
+	stats := PeriodStats{
+		Start: start,
+		End:   end,
+		Weeks: int(math.Ceil(end.Sub(start).Hours() / 24 / 7)),
+		Coach: coachKind(workouts),
+
+		DisciplineDistances: map[string]float64{},
+	}
+	activeDays := map[string]bool{}
+	activeWeeks := map[int]bool{}
+
+	for i := range workouts {
+		w := &workouts[i]
+		stats.Activities++
+		stats.Distance += w.Distance
+		stats.Duration += w.Duration
+		stats.Elevation += w.TotalElevationGain
+		stats.DisciplineDistances[discipline(w.SportType)] += w.Distance
+
+		day := localStartDate(*w)
+		activeDays[day.Format("2006-01-02")] = true
+		activeWeeks[int(day.Sub(time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, day.Location())).Hours()/24/7)] = true
+
+		if discipline(w.SportType) != disciplineRun {
+			continue
+		}
+		stats.Runs++
+		if stats.LongestRun == nil || w.Distance > stats.LongestRun.Distance {
+			stats.LongestRun = w
+		}
+		if w.Distance >= fastestRunMinDistance && (stats.FastestRun == nil || w.AverageSpeed > stats.FastestRun.AverageSpeed) {
+			stats.FastestRun = w
+		}
+	}
+
+	stats.ActiveDays = len(activeDays)
+	stats.ActiveWeeks = len(activeWeeks)
+	return stats
+}
+
+// percentChange describes how much the current value changed compared to the previous one.
+func percentChange(current float64, previous float64) string {
+	if previous == 0 {
+		return "n/a, nothing in the previous period"
+	}
+	return fmt.Sprintf("%+.0f%%", (current-previous)/previous*100)
+}
+
+func writePeriodStats(sb *strings.Builder, stats PeriodStats, loc Locale) {
+	sb.WriteString(fmt.Sprintf("- Activities: %d, of which %d runs\n", stats.Activities, stats.Runs))
+	sb.WriteString(fmt.Sprintf("- Total distance: %s in %s, %s of elevation gain\n",
+		loc.distance(stats.Distance), loc.duration(stats.Duration), loc.elevation(stats.Elevation)))
+	if len(stats.DisciplineDistances) > 1 {
+		var split []string
+		for _, d := range []string{disciplineRun, disciplineRide, disciplineSwim, disciplineHike} {
+			if distance := stats.DisciplineDistances[d]; distance > 0 {
+				split = append(split, fmt.Sprintf("%s %s", d, loc.distance(distance)))
+			}
+		}
+		sb.WriteString(fmt.Sprintf("- Distance by discipline: %s\n", strings.Join(split, ", ")))
+	}
+	if stats.LongestRun != nil {
+		sb.WriteString(fmt.Sprintf("- Longest run: %s, %s on %s\n",
+			stats.LongestRun.Name, loc.distance(stats.LongestRun.Distance), loc.date(localStartDate(*stats.LongestRun), "2 January")))
+	}
+	if stats.FastestRun != nil {
+		sb.WriteString(fmt.Sprintf("- Fastest run of at least %s: %s, %s at %s on %s\n",
+			loc.distance(fastestRunMinDistance), stats.FastestRun.Name, loc.distance(stats.FastestRun.Distance),
+			loc.pace(stats.FastestRun.AverageSpeed), loc.date(localStartDate(*stats.FastestRun), "2 January")))
+	}
+	sb.WriteString(fmt.Sprintf("- Consistency: active on %d days, trained in %d of %d weeks\n",
+		stats.ActiveDays, stats.ActiveWeeks, stats.Weeks))
+}
+
+// buildPeriodPrompt asks for a recap of a month, quarter, year or training block, compared with the period before.
+func buildPeriodPrompt(period string, current PeriodStats, previous PeriodStats, settings AthleteSettings) string {
+	var sb strings.Builder
+	loc := settings.locale()
+
+	sb.WriteString(fmt.Sprintf("%s Please write a recap of my training %s, %s. "+
+		"Don't go through it activity by activity, look at the big picture:\n\n",
+		settings.coachRole(current.Coach), period, describePeriod(period, current.Start, current.End, loc)))
+	writePeriodStats(&sb, current, loc)
+
+	sb.WriteString(fmt.Sprintf("\nThe %s before (%s) looked like this:\n\n", period, describePeriod(period, previous.Start, previous.End, loc)))
+	writePeriodStats(&sb, previous, loc)
+
+	sb.WriteString(fmt.Sprintf("\nCompared with the %s before: distance %s, time %s, runs %s.\n",
+		period,
+		percentChange(current.Distance, previous.Distance),
+		percentChange(float64(current.Duration), float64(previous.Duration)),
+		percentChange(float64(current.Runs), float64(previous.Runs))))
+
+	sb.WriteString("\nCall out the highlights, how consistent I was and how I progressed, and what to focus on next. " +
+		"You can use emojis if it make sense. Make the summary feel as human as possible." +
+		" Also it should be consise and not a lot of empty words." +
+		"Don't use markdown format, since it will not work when displayed." +
+		settings.writingInstructions())
+
+	return sb.String()
+}
+
+// generatePeriodRecap summarizes the athlete's training between start and end, compared with the period before.
+func generatePeriodRecap(period string, start time.Time, end time.Time, accessToken string, settings AthleteSettings) (string, error) {
+	previousStart, previousEnd := previousPeriod(period, start, end)
+
+	before := end
+	if now := time.Now(); now.Before(before) {
+		before = now
+	}
+	workouts, err := activitiesBetween(settings.AthleteID, accessToken, start, before)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch workouts: %w", err)
+	}
+	previousWorkouts, err := activitiesBetween(settings.AthleteID, accessToken, previousStart, previousEnd)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch workouts of the previous %s: %w", period, err)
+	}
+
+	prompt := buildPeriodPrompt(period,
+		computePeriodStats(settings.filterWorkouts(workouts), start, end),
+		computePeriodStats(settings.filterWorkouts(previousWorkouts), previousStart, previousEnd),
+		settings)
+	fmt.Printf("Sending this prompt to chatgpt: %s\n", prompt)
+
+	return generateSummary(prompt)
+}
+
+// resolveRecapPeriod works out the bounds of a recap in the athlete's timezone. Calendar periods are the ones date
+// falls in (today when empty), a block goes from "from" to "to", both inclusive.
+func resolveRecapPeriod(period string, date string, from string, to string, loc *time.Location, weekStart time.Weekday) (time.Time, time.Time, error) {
+	if period == periodBlock {
+		start, err := time.ParseInLocation(recapDateLayout, from, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid block start %q: %w", from, err)
+		}
+		end, err := time.ParseInLocation(recapDateLayout, to, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid block end %q: %w", to, err)
+		}
+		if end.Before(start) {
+			return time.Time{}, time.Time{}, fmt.Errorf("block ends on %s before it starts on %s", to, from)
+		}
+		return start, end.AddDate(0, 0, 1), nil
+	}
+
+	t := time.Now().In(loc)
+	if date != "" {
+		var err error
+		t, err = time.ParseInLocation(recapDateLayout, date, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid date %q: %w", date, err)
+		}
+	}
+	return periodBounds(period, t, weekStart)
+}
+
+func createPeriodRecapRunsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS period_recap_runs (
+		athlete_id BIGINT NOT NULL,
+		period VARCHAR(16) NOT NULL,
+		period_start DATE NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		attempts INT NOT NULL DEFAULT 1,
+		summary TEXT,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY (athlete_id, period, period_start)
+	);`)
+	if err != nil {
+		return err
+	}
+	return addColumnIfMissing(db, "period_recap_runs", "attempts", "INT NOT NULL DEFAULT 1")
+}
+
+// claimPeriodRecapRun marks the period's recap as running for this instance, retrying failed and stale runs the way
+// claimRecapRun does for weekly recaps.
+func claimPeriodRecapRun(db *sql.DB, athleteID int, period string, start time.Time) (bool, error) {
+	now := time.Now()
+	res, err := db.Exec("INSERT IGNORE INTO period_recap_runs (athlete_id, period, period_start, status, attempts, updated_at) VALUES (?, ?, ?, ?, 1, ?);",
+		athleteID, period, start.Format(recapDateLayout), recapStatusRunning, now)
+	if err != nil {
+		return false, err
+	}
+	claimed, err := res.RowsAffected()
+	if err != nil || claimed > 0 {
+		return claimed > 0, err
+	}
+
+	res, err = db.Exec("UPDATE period_recap_runs SET status=?, attempts=attempts+1, updated_at=? WHERE athlete_id=? AND period=? AND period_start=? AND status IN (?, ?) AND attempts<? AND updated_at<?;",
+		recapStatusRunning, now, athleteID, period, start.Format(recapDateLayout), recapStatusFailed, recapStatusRunning, maxRecapAttempts, now.Add(-recapRetryAfter))
+	if err != nil {
+		return false, err
+	}
+	claimed, err = res.RowsAffected()
+	return claimed > 0, err
+}
+
+// runDuePeriodRecaps generates the monthly, quarterly and yearly recaps of the last period that ended before the
+// athlete's scheduled recap was due. They are stored, to be read back from /recaps. Failed ones are retried like
+// weekly recaps.
+func runDuePeriodRecaps(db *sql.DB, schedule RecapSchedule, due time.Time) error {
+	for _, period := range schedule.Periods {
+		if period == periodWeek {
+			continue
+		}
+		currentStart, _, err := periodBounds(period, due, schedule.WeekStart)
+		if err != nil {
+			return err
+		}
+		start, end := previousPeriod(period, currentStart, currentStart)
+
+		claimed, err := claimPeriodRecapRun(db, schedule.AthleteID, period, start)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+
+		fmt.Printf("Running the %s recap of athlete %d for %s\n", period, schedule.AthleteID, describePeriod(period, start, end, englishLocale))
+		status := recapStatusStored
+		accessToken, err := getAccessTokenForAthlete(schedule.AthleteID)
+		summary := ""
+		if err == nil {
+			summary, err = generatePeriodRecap(period, start, end, accessToken, settingsOrDefault(schedule.AthleteID))
+		}
+		if err != nil {
+			fmt.Printf("The %s recap of athlete %d failed: %s\n", period, schedule.AthleteID, err)
+			status = recapStatusFailed
+		}
+		_, err = db.Exec("UPDATE period_recap_runs SET status=?, summary=?, updated_at=? WHERE athlete_id=? AND period=? AND period_start=?;",
+			status, summary, time.Now(), schedule.AthleteID, period, start.Format(recapDateLayout))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PeriodRecapRun records the recap of an athlete for one month, quarter or year.
+type PeriodRecapRun struct {
+	AthleteID   int       `json:"athlete_id"`
+	Period      string    `json:"period"`
+	PeriodStart string    `json:"period_start"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	Summary     string    `json:"summary,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func listPeriodRecapRuns(athleteID int, period string) ([]PeriodRecapRun, error) {
+	db, err := database()
+	if err != nil {
+		return nil, err
+	}
+
+	err = createPeriodRecapRunsTable(db)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT athlete_id, period, period_start, status, attempts, summary, updated_at FROM period_recap_runs WHERE athlete_id=? AND period=? ORDER BY period_start DESC;", athleteID, period)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []PeriodRecapRun{}
+	for rows.Next() {
+		var run PeriodRecapRun
+		var periodStart time.Time
+		var summary sql.NullString
+		err = rows.Scan(&run.AthleteID, &run.Period, &periodStart, &run.Status, &run.Attempts, &summary, &run.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		run.PeriodStart = periodStart.Format(recapDateLayout)
+		run.Summary = summary.String
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// recapHandler generates a recap on demand:
+// /recap?athlete_id={id}&period=week|month|quarter|year[&date=YYYY-MM-DD] or
+// /recap?athlete_id={id}&period=block&from=YYYY-MM-DD&to=YYYY-MM-DD
+func recapHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	athleteID, err := strconv.Atoi(query.Get("athlete_id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid athlete id 🙃🙃🙃: %s", err), http.StatusBadRequest)
+		return
+	}
+	if !authorizeAthlete(w, r, athleteID) {
+		return
+	}
+	period := query.Get("period")
+	if !isRecapPeriod(period) {
+		http.Error(w, fmt.Sprintf("Invalid period %q, expected week, month, quarter, year or block", period), http.StatusBadRequest)
+		return
+	}
+
+	accessToken, err := getAccessTokenForAthlete(athleteID)
+	if err != nil {
+		fmt.Println("Failed to get the access token:", err)
+		http.Error(w, "Failed to get the Strava access token", http.StatusInternalServerError)
+		return
+	}
+	loc, weekStart := athleteCalendar(athleteID, accessToken)
+	start, end, err := resolveRecapPeriod(period, query.Get("date"), query.Get("from"), query.Get("to"), loc, weekStart)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	summary, err := generatePeriodRecap(period, start, end, accessToken, settingsOrDefault(athleteID))
+	if err != nil {
+		fmt.Println("Failed to generate recap:", err)
+		http.Error(w, "Failed to generate recap", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"period":  period,
+		"start":   start.Format(recapDateLayout),
+		"end":     end.AddDate(0, 0, -1).Format(recapDateLayout),
+		"summary": summary,
+	})
+}
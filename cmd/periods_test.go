@@ -0,0 +1,179 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeriodBounds(t *testing.T) {
+	madrid := mustLoadLocation(t, "Europe/Madrid")
+
+	tests := []struct {
+		name      string
+		period    string
+		t         time.Time
+		weekStart time.Weekday
+		wantStart time.Time
+		wantEnd   time.Time
+		wantErr   bool
+	}{
+		{
+			name:      "week",
+			period:    periodWeek,
+			t:         time.Date(2024, 5, 8, 10, 0, 0, 0, time.UTC),
+			weekStart: time.Sunday,
+			wantStart: time.Date(2024, 5, 5, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 5, 12, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "last day of a month",
+			period:    periodMonth,
+			t:         time.Date(2024, 1, 31, 23, 59, 0, 0, time.UTC),
+			wantStart: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "leap day",
+			period:    periodMonth,
+			t:         time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "last day of the year",
+			period:    periodMonth,
+			t:         time.Date(2024, 12, 31, 20, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "next month in the athlete's timezone",
+			period:    periodMonth,
+			t:         time.Date(2024, 1, 31, 23, 30, 0, 0, time.UTC).In(madrid),
+			wantStart: time.Date(2024, 2, 1, 0, 0, 0, 0, madrid),
+			wantEnd:   time.Date(2024, 3, 1, 0, 0, 0, 0, madrid),
+		},
+		{
+			name:      "month in which the clocks go forward",
+			period:    periodMonth,
+			t:         time.Date(2024, 3, 31, 12, 0, 0, 0, madrid),
+			wantStart: time.Date(2024, 3, 1, 0, 0, 0, 0, madrid),
+			wantEnd:   time.Date(2024, 4, 1, 0, 0, 0, 0, madrid),
+		},
+		{
+			name:      "last day of a quarter",
+			period:    periodQuarter,
+			t:         time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "last quarter",
+			period:    periodQuarter,
+			t:         time.Date(2024, 11, 15, 12, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "year",
+			period:    periodYear,
+			t:         time.Date(2024, 12, 31, 23, 59, 0, 0, madrid),
+			wantStart: time.Date(2024, 1, 1, 0, 0, 0, 0, madrid),
+			wantEnd:   time.Date(2025, 1, 1, 0, 0, 0, 0, madrid),
+		},
+		{
+			name:    "block",
+			period:  periodBlock,
+			t:       time.Date(2024, 5, 8, 10, 0, 0, 0, time.UTC),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := periodBounds(tt.period, tt.t, tt.weekStart)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("periodBounds() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("periodBounds() = %s, %s, want %s, %s", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestPreviousPeriod(t *testing.T) {
+	madrid := mustLoadLocation(t, "Europe/Madrid")
+
+	tests := []struct {
+		name      string
+		period    string
+		start     time.Time
+		end       time.Time
+		wantStart time.Time
+	}{
+		{
+			name:      "week across the new year",
+			period:    periodWeek,
+			start:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			end:       time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2023, 12, 25, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "month after a leap February",
+			period:    periodMonth,
+			start:     time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			end:       time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "month across the new year",
+			period:    periodMonth,
+			start:     time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			end:       time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "month in which the clocks go back",
+			period:    periodMonth,
+			start:     time.Date(2024, 11, 1, 0, 0, 0, 0, madrid),
+			end:       time.Date(2024, 12, 1, 0, 0, 0, 0, madrid),
+			wantStart: time.Date(2024, 10, 1, 0, 0, 0, 0, madrid),
+		},
+		{
+			name:      "quarter across the new year",
+			period:    periodQuarter,
+			start:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			end:       time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "year",
+			period:    periodYear,
+			start:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			end:       time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "block of the same length",
+			period:    periodBlock,
+			start:     time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC),
+			end:       time.Date(2024, 4, 15, 0, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2024, 1, 22, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "block in which the clocks go forward",
+			period:    periodBlock,
+			start:     time.Date(2024, 3, 18, 0, 0, 0, 0, madrid),
+			end:       time.Date(2024, 4, 8, 0, 0, 0, 0, madrid),
+			wantStart: time.Date(2024, 2, 26, 0, 0, 0, 0, madrid),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := previousPeriod(tt.period, tt.start, tt.end)
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.start) {
+				t.Errorf("previousPeriod() = %s, %s, want %s, %s", start, end, tt.wantStart, tt.start)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Strava rate limits the application as a whole: a number of requests per 15 minutes, reset on the quarter hour,
+// and per day, reset at midnight UTC. Every response reports the limits and the usage so far.
+// See https://developers.strava.com/docs/rate-limits/
+const (
+	defaultShortTermLimit = 100
+	defaultDailyLimit     = 1000
+)
+
+type stravaRateLimit struct {
+	mu             sync.Mutex
+	shortTermLimit int
+	dailyLimit     int
+	shortTermUsage int
+	dailyUsage     int
+	updatedAt      time.Time
+}
+
+var stravaBudget = &stravaRateLimit{shortTermLimit: defaultShortTermLimit, dailyLimit: defaultDailyLimit}
+
+// recordStravaRateLimit keeps track of the limits and usage reported in a Strava response.
+func recordStravaRateLimit(header http.Header) {
+	limits := parseRateLimitHeader(header.Get("X-RateLimit-Limit"))
+	usage := parseRateLimitHeader(header.Get("X-RateLimit-Usage"))
+	if limits == nil || usage == nil {
+		return
+	}
+
+	stravaBudget.mu.Lock()
+	defer stravaBudget.mu.Unlock()
+	stravaBudget.shortTermLimit, stravaBudget.dailyLimit = limits[0], limits[1]
+	stravaBudget.shortTermUsage, stravaBudget.dailyUsage = usage[0], usage[1]
+	stravaBudget.updatedAt = time.Now()
+}
+
+// parseRateLimitHeader parses a "15-minute,daily" header value.
+func parseRateLimitHeader(value string) []int {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return nil
+	}
+	shortTerm, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil
+	}
+	daily, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil
+	}
+	return []int{shortTerm, daily}
+}
+
+// reserve claims one request out of the given share of the budget. When that share is used up it returns how long
+// to wait for the window to reset.
+func (l *stravaRateLimit) reserve(share float64, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	nextQuarter := now.UTC().Truncate(15 * time.Minute).Add(15 * time.Minute)
+	nextDay := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+
+	// Usage we heard of in an earlier window no longer counts.
+	if l.updatedAt.Before(nextDay.Add(-24 * time.Hour)) {
+		l.dailyUsage = 0
+	}
+	if l.updatedAt.Before(nextQuarter.Add(-15 * time.Minute)) {
+		l.shortTermUsage = 0
+	}
+
+	if float64(l.dailyUsage) >= share*float64(l.dailyLimit) {
+		return nextDay.Sub(now)
+	}
+	if float64(l.shortTermUsage) >= share*float64(l.shortTermLimit) {
+		return nextQuarter.Sub(now)
+	}
+
+	// Count the request right away so concurrent workers don't all take the last slot.
+	l.shortTermUsage++
+	l.dailyUsage++
+	l.updatedAt = now
+	return 0
+}
+
+// waitForStravaBudget blocks until a request fits in the given share of Strava's rate limits. Background work uses a
+// share below 1, so webhooks and the scheduler still have room while it runs.
+func waitForStravaBudget(share float64) {
+	for {
+		wait := stravaBudget.reserve(share, time.Now())
+		if wait == 0 {
+			return
+		}
+		fmt.Printf("Strava rate limit budget used up, waiting %s\n", wait.Round(time.Second))
+		time.Sleep(wait)
+	}
+}
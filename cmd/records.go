@@ -0,0 +1,370 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BestEffort is one of the standard distances Strava times within a run, e.g. the fastest 5K of a half marathon.
+type BestEffort struct {
+	Name        string  `json:"name"`
+	Distance    float64 `json:"distance"`
+	ElapsedTime int     `json:"elapsed_time"`
+	// PRRank is 1 when the effort is the athlete's fastest ever, 2 or 3 for their second and third fastest.
+	PRRank *int `json:"pr_rank"`
+}
+
+// computedEfforts are the distances Strava doesn't time, Stratonova finds the fastest stretch of them in the
+// activity's streams.
+var computedEfforts = map[string][]struct {
+	name     string
+	distance float64
+}{
+	disciplineRun:  {{"3K", 3000}, {"25K", 25000}},
+	disciplineRide: {{"10K", 10000}, {"20K", 20000}, {"40K", 40000}, {"100K", 100000}},
+}
+
+// PersonalRecord is an effort that was the athlete's fastest at its distance when it was done. The records of an
+// athlete are their PR history, the current record at a distance is the fastest of them.
+type PersonalRecord struct {
+	AthleteID   int     `json:"athlete_id"`
+	ActivityID  int     `json:"activity_id"`
+	Discipline  string  `json:"discipline"`
+	Effort      string  `json:"effort"`
+	Distance    float64 `json:"distance"`
+	ElapsedTime int     `json:"elapsed_time"`
+	// PreviousTime is the record it beat, 0 for the first effort at the distance.
+	PreviousTime int       `json:"previous_time"`
+	AchievedAt   time.Time `json:"achieved_at"`
+	// Baseline records are the first effort Stratonova computed at a distance, they're no achievement.
+	Baseline bool `json:"-"`
+}
+
+type effort struct {
+	name        string
+	distance    float64
+	elapsedTime int
+	// computed efforts come from the streams, the others from Strava
+	computed bool
+	stravaPR bool
+}
+
+func createPersonalRecordsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS personal_records (
+		athlete_id BIGINT NOT NULL,
+		activity_id BIGINT NOT NULL,
+		discipline VARCHAR(16) NOT NULL,
+		effort VARCHAR(32) NOT NULL,
+		distance DOUBLE NOT NULL,
+		elapsed_time INT NOT NULL,
+		previous_time INT NOT NULL,
+		baseline BOOLEAN NOT NULL,
+		achieved_at DATETIME NOT NULL,
+		PRIMARY KEY (activity_id, effort),
+		INDEX (athlete_id, discipline, effort)
+	);`)
+	return err
+}
+
+// workoutEfforts returns the best efforts of the workout: the ones Strava timed, and the ones computed from the
+// streams. The streams are only fetched when the workout is long enough for a computed distance.
+func workoutEfforts(w Workout, accessToken string, budgetShare float64) ([]effort, error) {
+	var efforts []effort
+	for _, e := range w.BestEfforts {
+		efforts = append(efforts, effort{
+			name:        e.Name,
+			distance:    e.Distance,
+			elapsedTime: e.ElapsedTime,
+			stravaPR:    e.PRRank != nil && *e.PRRank == 1,
+		})
+	}
+
+	distances := computedEfforts[discipline(w.SportType)]
+	if len(distances) == 0 || w.Distance < distances[0].distance || w.Manual {
+		return efforts, nil
+	}
+	distanceStream, timeStream, err := distanceStreams(w, accessToken, budgetShare)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range distances {
+		if elapsed, ok := fastestStretch(distanceStream, timeStream, d.distance); ok {
+			efforts = append(efforts, effort{name: d.name, distance: d.distance, elapsedTime: elapsed, computed: true})
+		}
+	}
+	return efforts, nil
+}
+
+// fastestStretch finds the shortest time it took to cover the distance anywhere in the streams.
+func fastestStretch(distances []float64, times []float64, distance float64) (int, bool) {
+	best := -1.0
+	start := 0
+	for end := range distances {
+		for start+1 < end && distances[end]-distances[start+1] >= distance {
+			start++
+		}
+		if distances[end]-distances[start] >= distance {
+			if elapsed := times[end] - times[start]; best < 0 || elapsed < best {
+				best = elapsed
+			}
+		}
+	}
+	return int(best), best >= 0
+}
+
+// distanceStreams returns the distance and time streams of the workout from the store, or fetches them from Strava,
+// within the budget share of the rate limits, and stores them.
+func distanceStreams(w Workout, accessToken string, budgetShare float64) ([]float64, []float64, error) {
+	distances, times, err := storedStreams(w.ID)
+	if err == nil {
+		return distances, times, nil
+	}
+	if err != sql.ErrNoRows {
+		fmt.Printf("Failed to read the streams of activity %d from the store, fetching them: %s\n", w.ID, err)
+	}
+
+	waitForStravaBudget(budgetShare)
+	distances, times, err = fetchDistanceStreams(w.ID, accessToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = storeStreams(w.Athlete.ID, w.ID, distances, times)
+	if err != nil {
+		fmt.Printf("Failed to store the streams of activity %d: %s\n", w.ID, err)
+	}
+	return distances, times, nil
+}
+
+// fetchDistanceStreams returns the distance and time streams of an activity, sampled together.
+func fetchDistanceStreams(activityID int, accessToken string) ([]float64, []float64, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://www.strava.com/api/v3/activities/%d/streams?keys=distance,time&key_by_type=true", activityID), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	recordStravaRateLimit(resp.Header)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("request failed with status: %d, response: %s", resp.StatusCode, string(body))
+	}
+
+	var streams map[string]struct {
+		Data []float64 `json:"data"`
+	}
+	err = json.Unmarshal(body, &streams)
+	if err != nil {
+		return nil, nil, err
+	}
+	distances, times := streams["distance"].Data, streams["time"].Data
+	if len(distances) != len(times) {
+		return nil, nil, fmt.Errorf("distance and time streams of activity %d differ in length", activityID)
+	}
+	return distances, times, nil
+}
+
+// detectPersonalRecords stores the workout's efforts that are records, and returns the ones worth celebrating. Strava's
+// efforts are records when Strava ranks them first, the computed ones when they beat the stored record, the first
+// computed effort at a distance is only kept as the baseline. Detecting the records of a workout again gives the same
+// result.
+func detectPersonalRecords(w Workout, accessToken string, budgetShare float64) ([]PersonalRecord, error) {
+	efforts, err := workoutEfforts(w, accessToken, budgetShare)
+	if err != nil || len(efforts) == 0 {
+		return nil, err
+	}
+
+	db, err := database()
+	if err != nil {
+		return nil, err
+	}
+
+	err = createPersonalRecordsTable(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []PersonalRecord
+	for _, e := range efforts {
+		var previous sql.NullInt64
+		err = db.QueryRow("SELECT MIN(elapsed_time) FROM personal_records WHERE athlete_id=? AND discipline=? AND effort=? AND activity_id<>?;",
+			w.Athlete.ID, discipline(w.SportType), e.name, w.ID).Scan(&previous)
+		if err != nil {
+			return nil, err
+		}
+
+		isRecord := e.stravaPR
+		if e.computed {
+			isRecord = !previous.Valid || e.elapsedTime < int(previous.Int64)
+		}
+		if !isRecord {
+			continue
+		}
+
+		record := PersonalRecord{
+			AthleteID:    w.Athlete.ID,
+			ActivityID:   w.ID,
+			Discipline:   discipline(w.SportType),
+			Effort:       e.name,
+			Distance:     e.distance,
+			ElapsedTime:  e.elapsedTime,
+			PreviousTime: int(previous.Int64),
+			AchievedAt:   w.Date,
+			Baseline:     e.computed && !previous.Valid,
+		}
+		_, err = db.Exec("INSERT IGNORE INTO personal_records (athlete_id, activity_id, discipline, effort, distance, elapsed_time, previous_time, baseline, achieved_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);",
+			record.AthleteID, record.ActivityID, record.Discipline, record.Effort, record.Distance, record.ElapsedTime, record.PreviousTime, record.Baseline, record.AchievedAt)
+		if err != nil {
+			return nil, err
+		}
+		if !record.Baseline {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// listPersonalRecords returns the athlete's records set between from and to, oldest first, without the baselines.
+func listPersonalRecords(athleteID int, from time.Time, to time.Time) ([]PersonalRecord, error) {
+	db, err := database()
+	if err != nil {
+		return nil, err
+	}
+
+	err = createPersonalRecordsTable(db)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT athlete_id, activity_id, discipline, effort, distance, elapsed_time, previous_time, achieved_at FROM personal_records WHERE athlete_id=? AND NOT baseline AND achieved_at>=? AND achieved_at<? ORDER BY achieved_at, distance;",
+		athleteID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []PersonalRecord{}
+	for rows.Next() {
+		var r PersonalRecord
+		err = rows.Scan(&r.AthleteID, &r.ActivityID, &r.Discipline, &r.Effort, &r.Distance, &r.ElapsedTime, &r.PreviousTime, &r.AchievedAt)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// currentRecords returns the athlete's fastest effort at every distance, by discipline and distance.
+func currentRecords(athleteID int) ([]PersonalRecord, error) {
+	all, err := listPersonalRecords(athleteID, time.Time{}, time.Now().AddDate(1, 0, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	best := map[string]PersonalRecord{}
+	for _, r := range all {
+		key := r.Discipline + "/" + r.Effort
+		if current, ok := best[key]; !ok || r.ElapsedTime < current.ElapsedTime {
+			best[key] = r
+		}
+	}
+	records := make([]PersonalRecord, 0, len(best))
+	for _, r := range best {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Discipline != records[j].Discipline {
+			return records[i].Discipline > records[j].Discipline
+		}
+		return records[i].Distance < records[j].Distance
+	})
+	return records, nil
+}
+
+func deleteActivityRecords(activityID int) error {
+	db, err := database()
+	if err != nil {
+		return err
+	}
+
+	err = createPersonalRecordsTable(db)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM personal_records WHERE activity_id=?;", activityID)
+	return err
+}
+
+// weekRecords returns the records of the week for its summary, none when they can't be read, a summary is still
+// worth posting without them.
+func weekRecords(athleteID int, weekStart time.Time, weekEnd time.Time) []PersonalRecord {
+	records, err := listPersonalRecords(athleteID, weekStart, weekEnd)
+	if err != nil {
+		fmt.Printf("Failed to list the records of athlete %d: %s\n", athleteID, err)
+		return nil
+	}
+	return records
+}
+
+// formatClock formats an effort's time like a race clock, "21:34" or "1:35:10".
+func formatClock(seconds int) string {
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds%3600/60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// recordsTitle adds the records to an activity's name, "Long Run ☄️ 🏆 10K & Half-Marathon PR".
+func recordsTitle(name string, records []PersonalRecord) string {
+	if len(records) == 0 {
+		return name
+	}
+	efforts := make([]string, len(records))
+	for i, r := range records {
+		efforts[i] = r.Effort
+	}
+	return fmt.Sprintf("%s 🏆 %s PR", name, strings.Join(efforts, " & "))
+}
+
+// recordsLine lists the records for an activity's description, "🏆 5K PR: 21:34 (-0:12)". It has no words, so it
+// needs no translation.
+func recordsLine(records []PersonalRecord) string {
+	parts := make([]string, len(records))
+	for i, r := range records {
+		parts[i] = fmt.Sprintf("🏆 %s PR: %s", r.Effort, formatClock(r.ElapsedTime))
+		if r.PreviousTime > 0 {
+			parts[i] += fmt.Sprintf(" (-%s)", formatClock(r.PreviousTime-r.ElapsedTime))
+		}
+	}
+	return strings.Join(parts, " · ")
+}
+
+// writeRecords tells the coach about the records of the week.
+func writeRecords(sb *strings.Builder, records []PersonalRecord, loc Locale) {
+	if len(records) == 0 {
+		return
+	}
+	sb.WriteString("\nNew personal records:\n")
+	for _, r := range records {
+		line := fmt.Sprintf("- %s %s in %s on %s", r.Effort, r.Discipline, formatClock(r.ElapsedTime), loc.date(r.AchievedAt, "Monday"))
+		if r.PreviousTime > 0 {
+			line += fmt.Sprintf(", %s faster than the previous record", formatClock(r.PreviousTime-r.ElapsedTime))
+		}
+		sb.WriteString(line + "\n")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+// steadyStreams samples the distance and time every second of stretches run at steady speeds, in m/s.
+func steadyStreams(stretches ...[2]float64) ([]float64, []float64) {
+	distances, times := []float64{0}, []float64{0}
+	for _, stretch := range stretches {
+		seconds, speed := int(stretch[0]), stretch[1]
+		for i := 0; i < seconds; i++ {
+			distances = append(distances, distances[len(distances)-1]+speed)
+			times = append(times, times[len(times)-1]+1)
+		}
+	}
+	return distances, times
+}
+
+func TestFastestStretch(t *testing.T) {
+	steadyDistances, steadyTimes := steadyStreams([2]float64{1500, 4})
+	surgeDistances, surgeTimes := steadyStreams([2]float64{600, 3}, [2]float64{200, 5}, [2]float64{600, 3})
+
+	tests := []struct {
+		name      string
+		distances []float64
+		times     []float64
+		distance  float64
+		want      int
+		wantFound bool
+	}{
+		{"steady pace", steadyDistances, steadyTimes, 1000, 250, true},
+		{"steady pace, 5K", steadyDistances, steadyTimes, 5000, 1250, true},
+		{"surge in the middle", surgeDistances, surgeTimes, 1000, 200, true},
+		{"surge and more", surgeDistances, surgeTimes, 1600, 400, true},
+		{"exactly the distance", []float64{0, 500, 1000}, []float64{0, 100, 210}, 1000, 210, true},
+		{"sparse samples", []float64{0, 600, 1200}, []float64{0, 120, 240}, 1000, 240, true},
+		{"pauses count", []float64{0, 500, 500, 1000}, []float64{0, 100, 400, 500}, 1000, 500, true},
+		{"shorter than the distance", steadyDistances, steadyTimes, 10000, 0, false},
+		{"no streams", nil, nil, 1000, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := fastestStretch(tt.distances, tt.times, tt.distance)
+			if found != tt.wantFound || (found && got != tt.want) {
+				t.Errorf("fastestStretch() = %d, %t, want %d, %t", got, found, tt.want, tt.wantFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Weekly recap runs end up either posted on an activity, stored when the athlete had no activity to post it on, or
+// failed. Failed runs are retried a few times.
+const (
+	recapStatusRunning = "running"
+	recapStatusPosted  = "posted"
+	recapStatusStored  = "stored"
+	recapStatusFailed  = "failed"
+)
+
+const (
+	schedulerInterval = time.Minute
+	maxRecapAttempts  = 3
+	recapRetryAfter   = 15 * time.Minute
+	recapCatchUpWeeks = 2
+	recapTargetSport  = "Run"
+	recapDateLayout   = "2006-01-02"
+)
+
+// RecapSchedule is when an athlete wants their weekly recap, in their own timezone.
+type RecapSchedule struct {
+	AthleteID int
+	Weekday   time.Weekday
+	Hour      int
+	Minute    int
+	Timezone  string
+	WeekStart time.Weekday
+	// Periods lists the recaps the athlete gets, the weekly one and any of month, quarter and year.
+	Periods []string
+	// CreatedAt is when the athlete first scheduled their recaps, the weeks that ended before are never caught up.
+	CreatedAt time.Time
+}
+
+// RecapRun records the weekly recap of an athlete for one week.
+type RecapRun struct {
+	AthleteID  int       `json:"athlete_id"`
+	WeekStart  string    `json:"week_start"`
+	Status     string    `json:"status"`
+	Attempts   int       `json:"attempts"`
+	ActivityID int       `json:"activity_id,omitempty"`
+	Summary    string    `json:"summary,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func createRecapTables(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS recap_schedules (
+		athlete_id BIGINT PRIMARY KEY,
+		weekday INT NOT NULL,
+		hour INT NOT NULL,
+		minute INT NOT NULL,
+		timezone VARCHAR(64) NOT NULL,
+		week_start INT NOT NULL DEFAULT 1,
+		periods VARCHAR(64) NOT NULL DEFAULT 'week',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`)
+	if err != nil {
+		return err
+	}
+	err = addColumnIfMissing(db, "recap_schedules", "week_start", "INT NOT NULL DEFAULT 1")
+	if err != nil {
+		return err
+	}
+	err = addColumnIfMissing(db, "recap_schedules", "periods", "VARCHAR(64) NOT NULL DEFAULT 'week'")
+	if err != nil {
+		return err
+	}
+	err = addColumnIfMissing(db, "recap_schedules", "created_at", "DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = createPeriodRecapRunsTable(db)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS weekly_recap_runs (
+		athlete_id BIGINT NOT NULL,
+		week_start DATE NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		attempts INT NOT NULL DEFAULT 1,
+		activity_id BIGINT,
+		summary TEXT,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY (athlete_id, week_start)
+	);`)
+	return err
+}
+
+func saveRecapSchedule(schedule RecapSchedule) error {
+	_, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return fmt.Errorf("unknown timezone %q: %w", schedule.Timezone, err)
+	}
+
+	db, err := database()
+	if err != nil {
+		return err
+	}
+
+	err = createRecapTables(db)
+	if err != nil {
+		return err
+	}
+
+	if len(schedule.Periods) == 0 {
+		schedule.Periods = []string{periodWeek}
+	}
+	for _, period := range schedule.Periods {
+		if !isRecapPeriod(period) || period == periodBlock {
+			return fmt.Errorf("invalid recap period %q, expected week, month, quarter or year", period)
+		}
+	}
+
+	// Changing a schedule keeps the time it was created at
+	_, err = db.Exec(`INSERT INTO recap_schedules (athlete_id, weekday, hour, minute, timezone, week_start, periods, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE weekday=VALUES(weekday), hour=VALUES(hour), minute=VALUES(minute), timezone=VALUES(timezone),
+			week_start=VALUES(week_start), periods=VALUES(periods);`,
+		schedule.AthleteID, int(schedule.Weekday), schedule.Hour, schedule.Minute, schedule.Timezone, int(schedule.WeekStart), strings.Join(schedule.Periods, ","), time.Now())
+	return err
+}
+
+func deleteRecapSchedule(athleteID int) error {
+	db, err := database()
+	if err != nil {
+		return err
+	}
+
+	err = createRecapTables(db)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM recap_schedules WHERE athlete_id=?;", athleteID)
+	return err
+}
+
+func getRecapSchedule(athleteID int) (RecapSchedule, error) {
+	db, err := database()
+	if err != nil {
+		return RecapSchedule{}, err
+	}
+
+	err = createRecapTables(db)
+	if err != nil {
+		return RecapSchedule{}, err
+	}
+
+	schedule := RecapSchedule{AthleteID: athleteID}
+	var periods string
+	err = db.QueryRow("SELECT weekday, hour, minute, timezone, week_start, periods, created_at FROM recap_schedules WHERE athlete_id=?;", athleteID).
+		Scan(&schedule.Weekday, &schedule.Hour, &schedule.Minute, &schedule.Timezone, &schedule.WeekStart, &periods, &schedule.CreatedAt)
+	if err == sql.ErrNoRows {
+		return RecapSchedule{}, fmt.Errorf("athlete %d has no recap schedule", athleteID)
+	}
+	schedule.Periods = strings.Split(periods, ",")
+	return schedule, err
+}
+
+// listRecapSchedules returns the schedules of the athletes Stratonova can still act for, the ones with tokens.
+func listRecapSchedules(db *sql.DB) ([]RecapSchedule, error) {
+	rows, err := db.Query("SELECT athlete_id, weekday, hour, minute, timezone, week_start, periods, created_at FROM recap_schedules WHERE athlete_id IN (SELECT athlete_id FROM strava_refresh_tokens);")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []RecapSchedule
+	for rows.Next() {
+		var s RecapSchedule
+		var periods string
+		err = rows.Scan(&s.AthleteID, &s.Weekday, &s.Hour, &s.Minute, &s.Timezone, &s.WeekStart, &periods, &s.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		s.Periods = strings.Split(periods, ",")
+		schedules = append(schedules, s)
+	}
+	return schedules, rows.Err()
+}
+
+func listRecapRuns(athleteID int) ([]RecapRun, error) {
+	db, err := database()
+	if err != nil {
+		return nil, err
+	}
+
+	err = createRecapTables(db)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT athlete_id, week_start, status, attempts, activity_id, summary, updated_at FROM weekly_recap_runs WHERE athlete_id=? ORDER BY week_start DESC;", athleteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []RecapRun{}
+	for rows.Next() {
+		var run RecapRun
+		var weekStart time.Time
+		var activityID sql.NullInt64
+		var summary sql.NullString
+		err = rows.Scan(&run.AthleteID, &weekStart, &run.Status, &run.Attempts, &activityID, &summary, &run.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		run.WeekStart = weekStart.Format(recapDateLayout)
+		run.ActivityID = int(activityID.Int64)
+		run.Summary = summary.String
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// lastScheduledRecap returns the most recent time, at or before now, the schedule was due.
+func lastScheduledRecap(now time.Time, schedule RecapSchedule, loc *time.Location) time.Time {
+	local := now.In(loc)
+	due := time.Date(local.Year(), local.Month(), local.Day(), schedule.Hour, schedule.Minute, 0, 0, loc)
+	due = due.AddDate(0, 0, -((int(local.Weekday()) - int(schedule.Weekday) + 7) % 7))
+	if due.After(local) {
+		due = due.AddDate(0, 0, -7)
+	}
+	return due
+}
+
+// recapWeek returns the calendar week recapped at the due time. A recap that is due on the first day of the week
+// looks back at the week that just finished, any other day recaps the week in progress.
+func recapWeek(due time.Time, weekStart time.Weekday) (time.Time, time.Time) {
+	if due.Weekday() == weekStart {
+		return calendarWeek(due.AddDate(0, 0, -1), weekStart)
+	}
+	return calendarWeek(due, weekStart)
+}
+
+// claimRecapRun marks the week's recap as running for this instance. It returns false when another instance already
+// ran it, is running it, or it failed too often to try again. A run left running by a crashed instance is retried
+// like a failed one.
+func claimRecapRun(db *sql.DB, athleteID int, weekStart time.Time) (bool, error) {
+	now := time.Now()
+	res, err := db.Exec("INSERT IGNORE INTO weekly_recap_runs (athlete_id, week_start, status, attempts, updated_at) VALUES (?, ?, ?, 1, ?);",
+		athleteID, weekStart.Format(recapDateLayout), recapStatusRunning, now)
+	if err != nil {
+		return false, err
+	}
+	claimed, err := res.RowsAffected()
+	if err != nil || claimed > 0 {
+		return claimed > 0, err
+	}
+
+	res, err = db.Exec("UPDATE weekly_recap_runs SET status=?, attempts=attempts+1, updated_at=? WHERE athlete_id=? AND week_start=? AND status IN (?, ?) AND attempts<? AND updated_at<?;",
+		recapStatusRunning, now, athleteID, weekStart.Format(recapDateLayout), recapStatusFailed, recapStatusRunning, maxRecapAttempts, now.Add(-recapRetryAfter))
+	if err != nil {
+		return false, err
+	}
+	claimed, err = res.RowsAffected()
+	return claimed > 0, err
+}
+
+func finishRecapRun(db *sql.DB, athleteID int, weekStart time.Time, status string, activityID int, summary string) error {
+	_, err := db.Exec("UPDATE weekly_recap_runs SET status=?, activity_id=?, summary=?, updated_at=? WHERE athlete_id=? AND week_start=?;",
+		status, activityID, summary, time.Now(), athleteID, weekStart.Format(recapDateLayout))
+	return err
+}
+
+// pickRecapActivity deliberately chooses the activity the recap is posted on: the last run of the week, or the last
+// activity of any kind when there was no run. It returns false when the week had no activities at all.
+func pickRecapActivity(workouts []Workout) (Workout, bool) {
+	var target Workout
+	found := false
+	for _, w := range workouts {
+		isRun := w.SportType == recapTargetSport
+		targetIsRun := found && target.SportType == recapTargetSport
+		if !found || (isRun && !targetIsRun) || (isRun == targetIsRun && w.Date.After(target.Date)) {
+			target = w
+			found = true
+		}
+	}
+	return target, found
+}
+
+// runWeeklyRecap summarizes the athlete's week and posts it. When there's no activity to post it on, the summary is
+// only stored with the run.
+func runWeeklyRecap(athleteID int, weekStart time.Time, weekEnd time.Time, due time.Time) (string, int, string, error) {
+	accessToken, err := getAccessTokenForAthlete(athleteID)
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	before := weekEnd
+	if due.Before(before) {
+		before = due
+	}
+	workouts, err := activitiesBetween(athleteID, accessToken, weekStart, before)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("failed to fetch workouts: %w", err)
+	}
+
+	settings := settingsOrDefault(athleteID)
+	// The digests of the prompt need the laps and splits of the detailed activities
+	workouts = fetchWorkoutDetails(settings.filterWorkouts(workouts), accessToken)
+	summary, title, err := generateWeeklySummary(workouts, weekStart, weekEnd, settings)
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	target, found := pickRecapActivity(workouts)
+	if !found {
+		fmt.Printf("Athlete %d had no activity in the week of %s, storing the recap only\n", athleteID, weekStart.Format(recapDateLayout))
+		return recapStatusStored, 0, summary, nil
+	}
+	if !settings.Rename {
+		// The activity keeps its name, without the hashtags Stratonova followed
+		_, cleaned := readHashtags(target)
+		title = cleaned.Name
+	}
+
+	err = updateWorkout(target.ID, summary, title, accessToken, sourceWeeklyRecap)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("failed to update workout description: %w", err)
+	}
+	return recapStatusPosted, target.ID, summary, nil
+}
+
+// dueWeek is a week whose recap is due.
+type dueWeek struct {
+	Due   time.Time
+	Start time.Time
+	End   time.Time
+}
+
+// dueRecapWeeks returns the weeks recapped at the latest due time and the recently missed ones, oldest first so a
+// missed week is caught up before the current one. A schedule without the weekly recap has none.
+func dueRecapWeeks(schedule RecapSchedule, latest time.Time) []dueWeek {
+	if !contains(schedule.Periods, periodWeek) {
+		return nil
+	}
+	var weeks []dueWeek
+	for weeksAgo := recapCatchUpWeeks - 1; weeksAgo >= 0; weeksAgo-- {
+		due := latest.AddDate(0, 0, -7*weeksAgo)
+		start, end := recapWeek(due, schedule.WeekStart)
+		if !end.After(schedule.CreatedAt) {
+			continue
+		}
+		weeks = append(weeks, dueWeek{Due: due, Start: start, End: end})
+	}
+	return weeks
+}
+
+// runDueRecaps runs every weekly and period recap that is due and hasn't run yet, including the weekly ones of
+// recently missed weeks. A new schedule doesn't catch up the weeks that were over before it was created.
+func runDueRecaps(db *sql.DB, now time.Time) error {
+	schedules, err := listRecapSchedules(db)
+	if err != nil {
+		return err
+	}
+
+	for _, schedule := range schedules {
+		loc, err := time.LoadLocation(schedule.Timezone)
+		if err != nil {
+			fmt.Printf("Athlete %d has an unknown timezone %q: %s\n", schedule.AthleteID, schedule.Timezone, err)
+			continue
+		}
+
+		latest := lastScheduledRecap(now, schedule, loc)
+		for _, week := range dueRecapWeeks(schedule, latest) {
+			claimed, err := claimRecapRun(db, schedule.AthleteID, week.Start)
+			if err != nil {
+				return err
+			}
+			if !claimed {
+				continue
+			}
+
+			fmt.Printf("Running the weekly recap of athlete %d for the week of %s\n", schedule.AthleteID, week.Start.Format(recapDateLayout))
+			status, activityID, summary, err := runWeeklyRecap(schedule.AthleteID, week.Start, week.End, week.Due)
+			if err != nil {
+				fmt.Printf("Weekly recap of athlete %d failed: %s\n", schedule.AthleteID, err)
+				status = recapStatusFailed
+			}
+			err = finishRecapRun(db, schedule.AthleteID, week.Start, status, activityID, summary)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = runDuePeriodRecaps(db, schedule, latest)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startScheduler checks every minute for weekly recaps that are due.
+func startScheduler() {
+	go func() {
+		var db *sql.DB
+		for {
+			if db == nil {
+				var err error
+				db, err = database()
+				if err == nil {
+					err = createRecapTables(db)
+				}
+				if err != nil {
+					fmt.Println("scheduler: failed to prepare the database:", err)
+					db = nil
+					time.Sleep(schedulerInterval)
+					continue
+				}
+			}
+
+			err := runDueRecaps(db, time.Now())
+			if err != nil {
+				fmt.Println("scheduler: failed to run due recaps:", err)
+			}
+			time.Sleep(schedulerInterval)
+		}
+	}()
+}
+
+// recapsHandler lists the athlete's weekly recaps, or with ?period=month|quarter|year the recaps of that period.
+func recapsHandler(w http.ResponseWriter, r *http.Request) {
+	athleteID, err := strconv.Atoi(r.URL.Query().Get("athlete_id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid athlete id 🙃🙃🙃: %s", err), http.StatusBadRequest)
+		return
+	}
+	if !authorizeAthlete(w, r, athleteID) {
+		return
+	}
+
+	if period := r.URL.Query().Get("period"); period != "" && period != periodWeek {
+		runs, err := listPeriodRecapRuns(athleteID, period)
+		if err != nil {
+			fmt.Println("Failed to list recaps:", err)
+			http.Error(w, "Failed to list recaps", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(runs)
+		return
+	}
+
+	runs, err := listRecapRuns(athleteID)
+	if err != nil {
+		fmt.Println("Failed to list weekly recaps:", err)
+		http.Error(w, "Failed to list weekly recaps", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLastScheduledRecap(t *testing.T) {
+	madrid := mustLoadLocation(t, "Europe/Madrid")
+	auckland := mustLoadLocation(t, "Pacific/Auckland")
+	sundayEvening := RecapSchedule{Weekday: time.Sunday, Hour: 18, Minute: 0}
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		schedule RecapSchedule
+		loc      *time.Location
+		want     time.Time
+	}{
+		{
+			name:     "just after the recap",
+			now:      time.Date(2024, 5, 12, 18, 30, 0, 0, madrid),
+			schedule: sundayEvening,
+			loc:      madrid,
+			want:     time.Date(2024, 5, 12, 18, 0, 0, 0, madrid),
+		},
+		{
+			name:     "right on time",
+			now:      time.Date(2024, 5, 12, 18, 0, 0, 0, madrid),
+			schedule: sundayEvening,
+			loc:      madrid,
+			want:     time.Date(2024, 5, 12, 18, 0, 0, 0, madrid),
+		},
+		{
+			name:     "just before the recap",
+			now:      time.Date(2024, 5, 12, 17, 59, 0, 0, madrid),
+			schedule: sundayEvening,
+			loc:      madrid,
+			want:     time.Date(2024, 5, 5, 18, 0, 0, 0, madrid),
+		},
+		{
+			name:     "mid week",
+			now:      time.Date(2024, 5, 15, 9, 0, 0, 0, madrid),
+			schedule: sundayEvening,
+			loc:      madrid,
+			want:     time.Date(2024, 5, 12, 18, 0, 0, 0, madrid),
+		},
+		{
+			name:     "on the athlete's day, not UTC's",
+			now:      time.Date(2024, 1, 14, 20, 0, 0, 0, time.UTC),
+			schedule: RecapSchedule{Weekday: time.Monday, Hour: 7, Minute: 15},
+			loc:      auckland,
+			want:     time.Date(2024, 1, 15, 7, 15, 0, 0, auckland),
+		},
+		{
+			name:     "across the new year",
+			now:      time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC),
+			schedule: RecapSchedule{Weekday: time.Sunday, Hour: 20, Minute: 0},
+			loc:      time.UTC,
+			want:     time.Date(2024, 12, 29, 20, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "clocks went forward since",
+			now:      time.Date(2024, 4, 1, 10, 0, 0, 0, madrid),
+			schedule: sundayEvening,
+			loc:      madrid,
+			want:     time.Date(2024, 3, 31, 18, 0, 0, 0, madrid),
+		},
+		{
+			name:     "clocks went forward this morning",
+			now:      time.Date(2024, 3, 31, 10, 0, 0, 0, madrid),
+			schedule: sundayEvening,
+			loc:      madrid,
+			want:     time.Date(2024, 3, 24, 18, 0, 0, 0, madrid),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lastScheduledRecap(tt.now, tt.schedule, tt.loc); !got.Equal(tt.want) {
+				t.Errorf("lastScheduledRecap() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecapWeek(t *testing.T) {
+	madrid := mustLoadLocation(t, "Europe/Madrid")
+
+	tests := []struct {
+		name      string
+		due       time.Time
+		weekStart time.Weekday
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{
+			name:      "week in progress",
+			due:       time.Date(2024, 5, 12, 18, 0, 0, 0, time.UTC),
+			weekStart: time.Monday,
+			wantStart: time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "week that just finished",
+			due:       time.Date(2024, 5, 13, 7, 0, 0, 0, time.UTC),
+			weekStart: time.Monday,
+			wantStart: time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "Sunday recap of a week starting on Sunday",
+			due:       time.Date(2024, 5, 12, 18, 0, 0, 0, time.UTC),
+			weekStart: time.Sunday,
+			wantStart: time.Date(2024, 5, 5, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 5, 12, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "Saturday recap of a week starting on Sunday",
+			due:       time.Date(2024, 5, 11, 18, 0, 0, 0, time.UTC),
+			weekStart: time.Sunday,
+			wantStart: time.Date(2024, 5, 5, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 5, 12, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "week that finished in the old year",
+			due:       time.Date(2025, 1, 6, 0, 30, 0, 0, time.UTC),
+			weekStart: time.Monday,
+			wantStart: time.Date(2024, 12, 30, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "week in which the clocks went forward",
+			due:       time.Date(2024, 4, 1, 7, 0, 0, 0, madrid),
+			weekStart: time.Monday,
+			wantStart: time.Date(2024, 3, 25, 0, 0, 0, 0, madrid),
+			wantEnd:   time.Date(2024, 4, 1, 0, 0, 0, 0, madrid),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := recapWeek(tt.due, tt.weekStart)
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("recapWeek() = %s, %s, want %s, %s", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestDueRecapWeeks(t *testing.T) {
+	latest := time.Date(2024, 5, 13, 7, 0, 0, 0, time.UTC)
+	weekly := RecapSchedule{Weekday: time.Monday, Hour: 7, WeekStart: time.Monday, Periods: []string{periodWeek}, CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	withPeriods := func(s RecapSchedule, periods ...string) RecapSchedule {
+		s.Periods = periods
+		return s
+	}
+	createdThisWeek := weekly
+	createdThisWeek.CreatedAt = time.Date(2024, 5, 8, 12, 0, 0, 0, time.UTC)
+
+	missedWeek := time.Date(2024, 4, 29, 0, 0, 0, 0, time.UTC)
+	lastWeek := time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		schedule   RecapSchedule
+		wantStarts []time.Time
+	}{
+		{"weekly", weekly, []time.Time{missedWeek, lastWeek}},
+		{"weekly and monthly", withPeriods(weekly, periodWeek, periodMonth), []time.Time{missedWeek, lastWeek}},
+		{"monthly only", withPeriods(weekly, periodMonth), nil},
+		{"monthly and yearly", withPeriods(weekly, periodMonth, periodYear), nil},
+		{"scheduled during the last week", createdThisWeek, []time.Time{lastWeek}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			weeks := dueRecapWeeks(tt.schedule, latest)
+			if len(weeks) != len(tt.wantStarts) {
+				t.Fatalf("dueRecapWeeks() = %d weeks, want %d", len(weeks), len(tt.wantStarts))
+			}
+			for i, week := range weeks {
+				if !week.Start.Equal(tt.wantStarts[i]) || !week.End.Equal(tt.wantStarts[i].AddDate(0, 0, 7)) {
+					t.Errorf("dueRecapWeeks()[%d] = %s to %s, want the week of %s", i, week.Start, week.End, tt.wantStarts[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie = "stratonova_session"
+	sessionTTL    = 30 * 24 * time.Hour
+)
+
+// startSession logs the athlete in, with a signed cookie "{athlete id}.{expiry}.{signature}". Sessions aren't
+// stored, changing the signing secret logs everybody out.
+func startSession(w http.ResponseWriter, athleteID int) {
+	expiry := time.Now().Add(sessionTTL)
+	payload := fmt.Sprintf("%d.%d", athleteID, expiry.Unix())
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    payload + "." + sign("session:"+payload),
+		Path:     "/",
+		Expires:  expiry,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.Server.PublicBaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func endSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+}
+
+// sessionAthlete returns the athlete logged in on the request's browser.
+func sessionAthlete(r *http.Request) (int, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return 0, false
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(sign("session:"+payload))) {
+		return 0, false
+	}
+
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return 0, false
+	}
+	athleteID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, false
+	}
+	return athleteID, true
+}
+
+// isSameOrigin tells whether a request was sent by a page of Stratonova. Cookies are sent along with requests from
+// any site, so the changes made with a session are checked against cross-site request forgery.
+func isSameOrigin(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return origin == config.Server.PublicBaseURL
+	}
+	referer := r.Header.Get("Referer")
+	return referer == config.Server.PublicBaseURL || strings.HasPrefix(referer, config.Server.PublicBaseURL+"/")
+}
+
+// loginHandler sends the browser to Strava to log in with, Strava redirects back to /exchange_token.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := newOAuthState(w)
+	if err != nil {
+		fmt.Println("Failed to generate the OAuth state:", err)
+		http.Error(w, "Failed to start the authorization", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, stravaAuthorizeURL(state), http.StatusFound)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Sorry, only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	endSession(w)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// disconnectHandler deauthorizes Stratonova on the logged in athlete's Strava account, deletes everything stored
+// about them and logs them out.
+func disconnectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Sorry, only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	p := requestPrincipal(r)
+	if p.admin {
+		http.Error(w, "The admin has no Strava account to disconnect, use the tokens revoke command", http.StatusBadRequest)
+		return
+	}
+
+	err := revokeAthlete(p.athleteID)
+	if err != nil {
+		fmt.Printf("Failed to disconnect athlete %d: %s\n", p.athleteID, err)
+		http.Error(w, "Failed to disconnect Stratonova from Strava", http.StatusInternalServerError)
+		return
+	}
+	endSession(w)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+var homePage = template.Must(template.New("home").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Stratonova™</title></head>
+<body>
+<h1>Stratonova™</h1>
+{{if not .AthleteID}}
+<p>Stratonova writes the weekly summaries of your runs on Strava for you.</p>
+<p><a href="/login">Log in with Strava</a></p>
+{{else}}
+<p>You're logged in as Strava athlete {{.AthleteID}}.</p>
+
+<h2>Your settings</h2>
+{{with .Schedule}}
+<p>Your recaps are posted every {{.Weekday}} at {{printf "%02d:%02d" .Hour .Minute}} ({{.Timezone}}), for weeks starting on {{.WeekStart}}. Recaps: {{range $i, $p := .Periods}}{{if $i}}, {{end}}{{$p}}{{end}}.</p>
+{{else}}
+<p>You have no recap schedule yet.</p>
+{{end}}
+<p><a href="/settings">Change your settings</a></p>
+
+<h2>Your summaries</h2>
+{{range .Recaps}}
+<h3>Week of {{.WeekStart}} ({{.Status}})</h3>
+{{if .ActivityID}}<p><a href="https://www.strava.com/activities/{{.ActivityID}}">Posted on Strava</a></p>{{end}}
+<p>{{.Summary}}</p>
+{{else}}
+<p>No summaries yet.</p>
+{{end}}
+
+<form method="post" action="/logout"><button type="submit">Log out</button></form>
+<form method="post" action="/disconnect" onsubmit="return confirm('Disconnect Stratonova from Strava and delete your data?')"><button type="submit">Disconnect Stratonova</button></form>
+{{end}}
+</body>
+</html>
+`))
+
+type homePageData struct {
+	AthleteID int
+	Schedule  *RecapSchedule
+	Recaps    []RecapRun
+}
+
+func mainPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var data homePageData
+	if athleteID, ok := sessionAthlete(r); ok {
+		data.AthleteID = athleteID
+		if schedule, err := getRecapSchedule(athleteID); err == nil {
+			data.Schedule = &schedule
+		}
+		recaps, err := listRecapRuns(athleteID)
+		if err != nil {
+			fmt.Printf("Failed to list the recaps of athlete %d: %s\n", athleteID, err)
+		}
+		data.Recaps = recaps
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := homePage.Execute(w, data)
+	if err != nil {
+		fmt.Println("Failed to render the home page:", err)
+	}
+}
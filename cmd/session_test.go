@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionCookieValue returns the value of a session cookie for the athlete expiring at the given time, signed with
+// the current secret.
+func sessionCookieValue(athleteID int, expiry time.Time) string {
+	payload := fmt.Sprintf("%d.%d", athleteID, expiry.Unix())
+	return payload + "." + sign("session:"+payload)
+}
+
+func TestSessionAthlete(t *testing.T) {
+	useAuthConfig(t, "admin-key", "signing-secret")
+
+	w := httptest.NewRecorder()
+	startSession(w, 1234)
+	started := w.Result().Cookies()[0].Value
+
+	inADay := time.Now().Add(24 * time.Hour)
+	useAuthConfig(t, "admin-key", "another-secret")
+	otherSecretValue := sessionCookieValue(1234, inADay)
+	useAuthConfig(t, "admin-key", "signing-secret")
+
+	valid := sessionCookieValue(1234, inADay)
+	signature := valid[strings.LastIndex(valid, ".")+1:]
+
+	tests := []struct {
+		name   string
+		value  string
+		want   int
+		wantOK bool
+	}{
+		{"started session", started, 1234, true},
+		{"signed cookie", valid, 1234, true},
+		{"expired cookie", sessionCookieValue(1234, time.Now().Add(-time.Minute)), 0, false},
+		{"another athlete", fmt.Sprintf("4321.%d.%s", inADay.Unix(), signature), 0, false},
+		{"extended expiry", fmt.Sprintf("1234.%d.%s", inADay.Add(365*24*time.Hour).Unix(), signature), 0, false},
+		{"tampered signature", fmt.Sprintf("1234.%d.%s", inADay.Unix(), sign("session:another")), 0, false},
+		{"signed with another secret", otherSecretValue, 0, false},
+		{"malformed", "1234", 0, false},
+		{"empty", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.value})
+			got, ok := sessionAthlete(r)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("sessionAthlete() = %d, %t, want %d, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	t.Run("without a cookie", func(t *testing.T) {
+		if got, ok := sessionAthlete(httptest.NewRequest("GET", "/", nil)); ok {
+			t.Errorf("sessionAthlete() = %d, %t, want 0, false", got, ok)
+		}
+	})
+}
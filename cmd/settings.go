@@ -0,0 +1,501 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	unitsMetric   = "metric"
+	unitsImperial = "imperial"
+)
+
+const (
+	metersPerMile = 1609.344
+	feetPerMeter  = 3.28084
+)
+
+// tones are the voices the coach can write the summaries in.
+var tones = []string{"friendly", "motivating", "funny", "straight-talking"}
+
+var (
+	languagePattern  = regexp.MustCompile(`^[\p{L} ()-]{2,32}$`)
+	sportTypePattern = regexp.MustCompile(`^[A-Za-z]+$`)
+)
+
+// AthleteSettings are the athlete's choices for how Stratonova treats their activities. The recap schedule is kept
+// in recap_schedules, it is part of the settings so it is edited in the same place.
+type AthleteSettings struct {
+	AthleteID int    `json:"athlete_id"`
+	Tone      string `json:"tone"`
+	Language  string `json:"language"`
+	Units     string `json:"units"`
+	// Rename lets Stratonova rename activities, otherwise it only writes their descriptions.
+	Rename bool `json:"rename"`
+	// Sports are the Strava sport types Stratonova processes, all of them when empty.
+	Sports []string `json:"sports"`
+	// Plan is the hours a week the athlete plans per discipline, for the multisport summary.
+	Plan    map[string]float64 `json:"plan"`
+	Filters ActivityFilters    `json:"filters"`
+	Recap   *RecapSettings     `json:"recap"`
+}
+
+// RecapSettings is the recap schedule as the settings page and API show it.
+type RecapSettings struct {
+	Weekday   time.Weekday `json:"weekday"`
+	At        string       `json:"at"`
+	Timezone  string       `json:"timezone"`
+	WeekStart time.Weekday `json:"week_start"`
+	Periods   []string     `json:"periods"`
+}
+
+func defaultAthleteSettings(athleteID int) AthleteSettings {
+	return AthleteSettings{
+		AthleteID: athleteID,
+		Tone:      "friendly",
+		Language:  "English",
+		Units:     unitsMetric,
+		Rename:    true,
+	}
+}
+
+func createAthleteSettingsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS athlete_settings (
+		athlete_id BIGINT PRIMARY KEY,
+		tone VARCHAR(32) NOT NULL,
+		language VARCHAR(32) NOT NULL,
+		units VARCHAR(16) NOT NULL,
+		rename_activities BOOLEAN NOT NULL,
+		sports VARCHAR(255) NOT NULL,
+		plan VARCHAR(255) NOT NULL DEFAULT '',
+		filters VARCHAR(1024) NOT NULL DEFAULT '',
+		updated_at DATETIME NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+	err = addColumnIfMissing(db, "athlete_settings", "plan", "VARCHAR(255) NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	return addColumnIfMissing(db, "athlete_settings", "filters", "VARCHAR(1024) NOT NULL DEFAULT ''")
+}
+
+// getAthleteSettings returns the athlete's settings, the defaults when they never changed them.
+func getAthleteSettings(athleteID int) (AthleteSettings, error) {
+	db, err := database()
+	if err != nil {
+		return AthleteSettings{}, err
+	}
+
+	err = createAthleteSettingsTable(db)
+	if err != nil {
+		return AthleteSettings{}, err
+	}
+
+	settings := defaultAthleteSettings(athleteID)
+	var sports, plan, filters string
+	err = db.QueryRow("SELECT tone, language, units, rename_activities, sports, plan, filters FROM athlete_settings WHERE athlete_id=?;", athleteID).
+		Scan(&settings.Tone, &settings.Language, &settings.Units, &settings.Rename, &sports, &plan, &filters)
+	if err != nil && err != sql.ErrNoRows {
+		return AthleteSettings{}, err
+	}
+	if sports != "" {
+		settings.Sports = strings.Split(sports, ",")
+	}
+	settings.Plan, err = parsePlan(plan)
+	if err != nil {
+		return AthleteSettings{}, err
+	}
+	settings.Filters, err = parseFilters(filters)
+	if err != nil {
+		return AthleteSettings{}, err
+	}
+
+	schedule, err := getRecapSchedule(athleteID)
+	if err == nil {
+		settings.Recap = &RecapSettings{
+			Weekday:   schedule.Weekday,
+			At:        fmt.Sprintf("%02d:%02d", schedule.Hour, schedule.Minute),
+			Timezone:  schedule.Timezone,
+			WeekStart: schedule.WeekStart,
+			Periods:   schedule.Periods,
+		}
+	}
+	return settings, nil
+}
+
+// settingsOrDefault returns the athlete's settings, falling back to the defaults when they can't be read, so a
+// database hiccup doesn't stop a recap.
+func settingsOrDefault(athleteID int) AthleteSettings {
+	settings, err := getAthleteSettings(athleteID)
+	if err != nil {
+		fmt.Printf("Failed to read the settings of athlete %d, using the defaults: %s\n", athleteID, err)
+		return defaultAthleteSettings(athleteID)
+	}
+	return settings
+}
+
+func (s AthleteSettings) validate() error {
+	var problems []string
+	if !contains(tones, s.Tone) {
+		problems = append(problems, fmt.Sprintf("tone must be one of %s", strings.Join(tones, ", ")))
+	}
+	if !languagePattern.MatchString(s.Language) {
+		problems = append(problems, fmt.Sprintf("invalid language %q", s.Language))
+	}
+	if s.Units != unitsMetric && s.Units != unitsImperial {
+		problems = append(problems, fmt.Sprintf("units must be %s or %s", unitsMetric, unitsImperial))
+	}
+	for _, sport := range s.Sports {
+		if !sportTypePattern.MatchString(sport) {
+			problems = append(problems, fmt.Sprintf("invalid sport type %q, expected a Strava sport type like Run or Ride", sport))
+		}
+	}
+	if len(strings.Join(s.Sports, ",")) > 255 {
+		problems = append(problems, "too many sports")
+	}
+	for d, hours := range s.Plan {
+		if !contains(planDisciplines, d) {
+			problems = append(problems, fmt.Sprintf("invalid plan discipline %q, expected one of %s", d, strings.Join(planDisciplines, ", ")))
+		}
+		if hours < 0 || hours > maxPlanHours {
+			problems = append(problems, fmt.Sprintf("invalid plan of %g hours for %s, expected 0 to %d", hours, d, maxPlanHours))
+		}
+	}
+	problems = append(problems, s.Filters.problems()...)
+	if r := s.Recap; r != nil {
+		if r.Weekday < time.Sunday || r.Weekday > time.Saturday {
+			problems = append(problems, fmt.Sprintf("invalid recap weekday %d, expected 0 (Sunday) to 6 (Saturday)", r.Weekday))
+		}
+		if r.WeekStart < time.Sunday || r.WeekStart > time.Saturday {
+			problems = append(problems, fmt.Sprintf("invalid week start %d, expected 0 (Sunday) to 6 (Saturday)", r.WeekStart))
+		}
+		if _, err := time.Parse("15:04", r.At); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid recap time %q, expected HH:MM", r.At))
+		}
+		if _, err := time.LoadLocation(r.Timezone); err != nil {
+			problems = append(problems, fmt.Sprintf("unknown timezone %q", r.Timezone))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid settings: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// saveAthleteSettings validates and stores the settings, and the recap schedule along with them. Settings without a
+// recap turn the recaps off.
+func saveAthleteSettings(settings AthleteSettings) error {
+	err := settings.validate()
+	if err != nil {
+		return err
+	}
+
+	if r := settings.Recap; r == nil {
+		err = deleteRecapSchedule(settings.AthleteID)
+		if err != nil {
+			return err
+		}
+	} else {
+		at, _ := time.Parse("15:04", r.At)
+		err = saveRecapSchedule(RecapSchedule{
+			AthleteID: settings.AthleteID,
+			Weekday:   r.Weekday,
+			Hour:      at.Hour(),
+			Minute:    at.Minute(),
+			Timezone:  r.Timezone,
+			WeekStart: r.WeekStart,
+			Periods:   r.Periods,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	db, err := database()
+	if err != nil {
+		return err
+	}
+
+	err = createAthleteSettingsTable(db)
+	if err != nil {
+		return err
+	}
+
+	filters, err := json.Marshal(settings.Filters)
+	if err != nil {
+		return err
+	}
+	if len(filters) > 1024 {
+		return fmt.Errorf("invalid settings: too many filters")
+	}
+
+	_, err = db.Exec("REPLACE INTO athlete_settings (athlete_id, tone, language, units, rename_activities, sports, plan, filters, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);",
+		settings.AthleteID, settings.Tone, settings.Language, settings.Units, settings.Rename, strings.Join(settings.Sports, ","), formatPlan(settings.Plan), string(filters), time.Now())
+	return err
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// coachRole opens a prompt in the tone the athlete chose, for a coach of the given kind, see coachKind.
+func (s AthleteSettings) coachRole(kind string) string {
+	return fmt.Sprintf("You are my %s %s coach.", s.Tone, kind)
+}
+
+// writingInstructions closes a prompt with the language and units the athlete chose.
+func (s AthleteSettings) writingInstructions() string {
+	units := "kilometers and meters"
+	if s.Units == unitsImperial {
+		units = "miles and feet"
+	}
+	return fmt.Sprintf(" Write it in %s, with distances in %s.", s.Language, units)
+}
+
+// settingsAPIHandler returns the athlete's settings as JSON on GET, and replaces them on PUT.
+func settingsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	athleteID, err := athleteIDParam(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid athlete id 🙃🙃🙃: %s", err), http.StatusBadRequest)
+		return
+	}
+	if !authorizeAthlete(w, r, athleteID) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		settings := defaultAthleteSettings(athleteID)
+		err = json.NewDecoder(r.Body).Decode(&settings)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid settings: %s", err), http.StatusBadRequest)
+			return
+		}
+		settings.AthleteID = athleteID
+		if err = settings.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = saveAthleteSettings(settings)
+		if err != nil {
+			fmt.Println("Failed to save settings:", err)
+			http.Error(w, "Failed to save settings", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Sorry, only GET and PUT are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	settings, err := getAthleteSettings(athleteID)
+	if err != nil {
+		fmt.Println("Failed to read settings:", err)
+		http.Error(w, "Failed to read settings", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+var settingsPage = template.Must(template.New("settings").Funcs(template.FuncMap{
+	"join":            strings.Join,
+	"distanceInUnits": distanceInUnits,
+	"minutes":         func(seconds int) int { return seconds / 60 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Stratonova™ settings</title></head>
+<body>
+<h1>Settings</h1>
+{{if .Error}}<p style="color: red">{{.Error}}</p>{{end}}
+{{if .Saved}}<p>Settings saved ✅</p>{{end}}
+{{with .Settings}}
+<form method="post" action="/settings?athlete_id={{.AthleteID}}">
+<p><label>Tone <select name="tone">{{$tone := .Tone}}{{range $.Tones}}<option{{if eq . $tone}} selected{{end}}>{{.}}</option>{{end}}</select></label></p>
+<p><label>Language <input name="language" value="{{.Language}}"></label> activity names, numbers and dates are translated into {{join $.Languages ", "}}, the summaries into any language</p>
+<p><label>Units <select name="units">
+<option value="metric"{{if eq .Units "metric"}} selected{{end}}>metric (km)</option>
+<option value="imperial"{{if eq .Units "imperial"}} selected{{end}}>imperial (mi)</option>
+</select></label></p>
+<p><label><input type="checkbox" name="rename" value="true"{{if .Rename}} checked{{end}}> Rename my activities, otherwise only write their descriptions</label></p>
+<p><label>Sports, as Strava sport types, empty for all <input name="sports" value="{{join .Sports ","}}" placeholder="Run,TrailRun"></label></p>
+<p>Weekly plan, in hours{{$plan := .Plan}}{{range $.PlanDisciplines}} <label>{{.}} <input name="plan_{{.}}" size="3" value="{{with index $plan .}}{{.}}{{end}}"></label>{{end}}</p>
+<h2>Filters</h2>
+{{$units := .Units}}{{with .Filters}}
+<p>Leave alone <label><input type="checkbox" name="skip_commutes" value="true"{{if .SkipCommutes}} checked{{end}}> commutes</label>
+<label><input type="checkbox" name="skip_trainer" value="true"{{if .SkipTrainer}} checked{{end}}> trainer activities</label>
+<label><input type="checkbox" name="skip_private" value="true"{{if .SkipPrivate}} checked{{end}}> private activities</label>
+<label><input type="checkbox" name="skip_manual" value="true"{{if .SkipManual}} checked{{end}}> manual entries</label></p>
+<p><label>Shorter than <input name="min_distance" size="4" value="{{with .MinDistance}}{{distanceInUnits . $units}}{{end}}"> {{if eq $units "imperial"}}mi{{else}}km{{end}}</label>
+<label>or <input name="min_duration" size="4" value="{{with .MinDuration}}{{minutes .}}{{end}}"> minutes</label></p>
+<p><label>Sport types <input name="exclude_sports" value="{{join .ExcludeSports ","}}" placeholder="Walk,EBikeRide"></label>
+<label>Gear <input name="exclude_gear" value="{{join .ExcludeGear ","}}" placeholder="b1234"></label></p>
+{{end}}
+<h2>Recaps</h2>
+<p><label><input type="checkbox" name="recap" value="true"{{if .Recap}} checked{{end}}> Post recaps</label></p>
+{{$recap := .Recap}}
+<p><label>Day <select name="recap_weekday">{{range $.Weekdays}}<option value="{{printf "%d" .}}"{{if and $recap (eq . $recap.Weekday)}} selected{{end}}>{{.}}</option>{{end}}</select></label>
+<label>at <input name="recap_at" value="{{if $recap}}{{$recap.At}}{{else}}20:00{{end}}"></label></p>
+<p><label>Timezone <input name="recap_timezone" value="{{if $recap}}{{$recap.Timezone}}{{else}}UTC{{end}}"></label></p>
+<p><label>Weeks start on <select name="recap_week_start">{{range $.Weekdays}}<option value="{{printf "%d" .}}"{{if $recap}}{{if eq . $recap.WeekStart}} selected{{end}}{{else if eq . 1}} selected{{end}}>{{.}}</option>{{end}}</select></label></p>
+<p><label>Recaps <input name="recap_periods" value="{{if $recap}}{{join $recap.Periods ","}}{{else}}week{{end}}" placeholder="week,month"></label></p>
+<p><button type="submit">Save</button> <a href="/">Back</a></p>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type settingsPageData struct {
+	Settings        AthleteSettings
+	Tones           []string
+	Weekdays        []time.Weekday
+	PlanDisciplines []string
+	Languages       []string
+	Error           string
+	Saved           bool
+}
+
+// settingsPageHandler shows the athlete's settings as a form on GET, and saves the submitted form on POST.
+func settingsPageHandler(w http.ResponseWriter, r *http.Request) {
+	athleteID, err := athleteIDParam(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid athlete id 🙃🙃🙃: %s", err), http.StatusBadRequest)
+		return
+	}
+	if !authorizeAthlete(w, r, athleteID) {
+		return
+	}
+
+	data := settingsPageData{
+		Tones:           tones,
+		Weekdays:        []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday},
+		PlanDisciplines: planDisciplines,
+		Languages:       catalogLanguages(),
+	}
+	status := http.StatusOK
+
+	switch r.Method {
+	case "GET":
+		data.Settings, err = getAthleteSettings(athleteID)
+		if err != nil {
+			fmt.Println("Failed to read settings:", err)
+			http.Error(w, "Failed to read settings", http.StatusInternalServerError)
+			return
+		}
+	case "POST":
+		data.Settings = settingsFromForm(r, athleteID)
+		err = data.Settings.validate()
+		if err == nil {
+			err = saveAthleteSettings(data.Settings)
+			if err != nil {
+				fmt.Println("Failed to save settings:", err)
+				err = fmt.Errorf("failed to save settings")
+			}
+		}
+		if err != nil {
+			data.Error = err.Error()
+			status = http.StatusBadRequest
+		}
+		data.Saved = err == nil
+	default:
+		http.Error(w, "Sorry, only GET and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err = settingsPage.Execute(w, data)
+	if err != nil {
+		fmt.Println("Failed to render the settings page:", err)
+	}
+}
+
+func settingsFromForm(r *http.Request, athleteID int) AthleteSettings {
+	settings := AthleteSettings{
+		AthleteID: athleteID,
+		Tone:      r.FormValue("tone"),
+		Language:  strings.TrimSpace(r.FormValue("language")),
+		Units:     r.FormValue("units"),
+		Rename:    r.FormValue("rename") == "true",
+		Sports:    splitList(r.FormValue("sports")),
+		Plan:      map[string]float64{},
+	}
+	settings.Filters = ActivityFilters{
+		SkipCommutes:  r.FormValue("skip_commutes") == "true",
+		SkipTrainer:   r.FormValue("skip_trainer") == "true",
+		SkipPrivate:   r.FormValue("skip_private") == "true",
+		SkipManual:    r.FormValue("skip_manual") == "true",
+		MinDistance:   metersFromUnits(formNumber(r, "min_distance"), settings.Units),
+		MinDuration:   int(formNumber(r, "min_duration") * 60),
+		ExcludeSports: splitList(r.FormValue("exclude_sports")),
+		ExcludeGear:   splitList(r.FormValue("exclude_gear")),
+	}
+	for _, d := range planDisciplines {
+		if hours := strings.TrimSpace(r.FormValue("plan_" + d)); hours != "" {
+			h, err := strconv.ParseFloat(hours, 64)
+			if err != nil {
+				h = -1
+			}
+			settings.Plan[d] = h
+		}
+	}
+	if r.FormValue("recap") == "true" {
+		settings.Recap = &RecapSettings{
+			At:       strings.TrimSpace(r.FormValue("recap_at")),
+			Timezone: strings.TrimSpace(r.FormValue("recap_timezone")),
+			Periods:  splitList(r.FormValue("recap_periods")),
+		}
+		settings.Recap.Weekday = formWeekday(r, "recap_weekday")
+		settings.Recap.WeekStart = formWeekday(r, "recap_week_start")
+	}
+	return settings
+}
+
+// formWeekday reads a weekday number from the form, an invalid one is turned down by validate.
+func formWeekday(r *http.Request, name string) time.Weekday {
+	day, err := strconv.Atoi(r.FormValue(name))
+	if err != nil {
+		return -1
+	}
+	return time.Weekday(day)
+}
+
+// formNumber reads an optional number from the form, zero when blank. An invalid one is turned into -1 for
+// validate to turn down.
+func formNumber(r *http.Request, name string) float64 {
+	value := strings.TrimSpace(r.FormValue(name))
+	if value == "" {
+		return 0
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return -1
+	}
+	return number
+}
+
+// splitList splits a comma separated list, dropping the blanks.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
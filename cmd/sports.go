@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Disciplines group Strava's many sport types into the ones Stratonova treats differently.
+const (
+	disciplineRun      = "run"
+	disciplineRide     = "ride"
+	disciplineSwim     = "swim"
+	disciplineHike     = "hike"
+	disciplineStrength = "strength"
+	disciplineOther    = "other"
+)
+
+// disciplines maps Strava sport types to disciplines, see
+// https://developers.strava.com/docs/reference/#api-models-SportType
+var disciplines = map[string]string{
+	"Run":                           disciplineRun,
+	"TrailRun":                      disciplineRun,
+	"VirtualRun":                    disciplineRun,
+	"Ride":                          disciplineRide,
+	"VirtualRide":                   disciplineRide,
+	"GravelRide":                    disciplineRide,
+	"MountainBikeRide":              disciplineRide,
+	"EBikeRide":                     disciplineRide,
+	"EMountainBikeRide":             disciplineRide,
+	"Velomobile":                    disciplineRide,
+	"Swim":                          disciplineSwim,
+	"Hike":                          disciplineHike,
+	"Walk":                          disciplineHike,
+	"WeightTraining":                disciplineStrength,
+	"Crossfit":                      disciplineStrength,
+	"HighIntensityIntervalTraining": disciplineStrength,
+	"Workout":                       disciplineStrength,
+	"Yoga":                          disciplineStrength,
+	"Pilates":                       disciplineStrength,
+}
+
+const metersPerYard = 0.9144
+
+func discipline(sportType string) string {
+	if d, ok := disciplines[sportType]; ok {
+		return d
+	}
+	return disciplineOther
+}
+
+// activityNoun is what the athlete calls an activity of the discipline, e.g. "this ride of mine".
+func activityNoun(sportType string) string {
+	switch discipline(sportType) {
+	case disciplineRun:
+		return "run"
+	case disciplineRide:
+		return "ride"
+	case disciplineSwim:
+		return "swim"
+	case disciplineHike:
+		return strings.ToLower(sportType)
+	case disciplineStrength:
+		return "strength session"
+	}
+	return "workout"
+}
+
+// coachKind is the coach the prompts address, a running coach for runners, a triathlon coach for swim, bike and run,
+// an endurance coach when the athlete trained other mixes of disciplines.
+func coachKind(workouts []Workout) string {
+	seen := map[string]bool{}
+	for _, w := range workouts {
+		if d := discipline(w.SportType); d != disciplineStrength && d != disciplineOther {
+			seen[d] = true
+		}
+	}
+	if len(seen) == 1 {
+		switch {
+		case seen[disciplineRide]:
+			return "cycling"
+		case seen[disciplineSwim]:
+			return "swimming"
+		case seen[disciplineHike]:
+			return "hiking"
+		}
+		return "running"
+	}
+	if len(seen) == 0 {
+		return "running"
+	}
+	if seen[disciplineSwim] && seen[disciplineRide] && seen[disciplineRun] {
+		return "triathlon"
+	}
+	return "endurance"
+}
+
+// formatIntensity describes how fast an activity went the way its discipline counts it: pace for runs and hikes,
+// speed for rides, time per 100 for swims. Strength sessions have none.
+func formatIntensity(w Workout, loc Locale) string {
+	switch discipline(w.SportType) {
+	case disciplineRun, disciplineHike:
+		return loc.pace(w.AverageSpeed)
+	case disciplineRide:
+		if w.AverageWatts > 0 {
+			return fmt.Sprintf("%s, %.0f W", loc.speed(w.AverageSpeed), w.AverageWatts)
+		}
+		return loc.speed(w.AverageSpeed)
+	case disciplineSwim:
+		return loc.swimPace(w.AverageSpeed)
+	}
+	return ""
+}
+
+// describeWorkout is the line a workout gets in a prompt, e.g. "42.10 km in 1h 30m at 28.1 km/h".
+func describeWorkout(w Workout, loc Locale) string {
+	if discipline(w.SportType) == disciplineStrength || w.Distance == 0 {
+		if w.HeartRate > 0 {
+			return fmt.Sprintf("%s at %.0f bpm on average", loc.duration(w.Duration), w.HeartRate)
+		}
+		return loc.duration(w.Duration)
+	}
+	line := fmt.Sprintf("%s in %s", loc.distance(w.Distance), loc.duration(w.Duration))
+	if intensity := formatIntensity(w, loc); intensity != "" {
+		line += " at " + intensity
+	}
+	return line
+}
+
+// classifyWorkout names an activity after the kind of training it was, a race when the athlete tagged it #race. It
+// returns false for the sports Stratonova has no classifier for.
+func classifyWorkout(w Workout) (string, bool) {
+	tags, w := readHashtags(w)
+	name, ok := classifyDiscipline(w)
+	switch {
+	case !ok:
+		return "", false
+	case tags.Race:
+		return "Race Day 🏁", true
+	case tags.Treadmill && discipline(w.SportType) == disciplineRun:
+		return "Treadmill " + name, true
+	}
+	return name, true
+}
+
+func classifyDiscipline(w Workout) (string, bool) {
+	switch discipline(w.SportType) {
+	case disciplineRun:
+		return generateActivityName(w), true
+	case disciplineRide:
+		return classifyRide(w), true
+	case disciplineSwim:
+		return classifySwim(w), true
+	case disciplineHike:
+		return classifyHike(w), true
+	case disciplineStrength:
+		return classifyStrength(w), true
+	}
+	return "", false
+}
+
+// lapEffort is how hard a lap went, by power when the ride has it, otherwise by speed.
+func lapEffort(lap Lap) float64 {
+	if lap.AverageWatts > 0 {
+		return lap.AverageWatts
+	}
+	return lap.AverageSpeed
+}
+
+// countEffortJumps counts the laps whose effort differs from the previous lap by more than the given ratio, the
+// mark of intervals.
+func countEffortJumps(laps []Lap, ratio float64) int {
+	jumps := 0
+	for i := 1; i < len(laps); i++ {
+		previous, current := lapEffort(laps[i-1]), lapEffort(laps[i])
+		if previous > 0 && math.Abs(current-previous)/previous > ratio {
+			jumps++
+		}
+	}
+	return jumps
+}
+
+// classifyRide tells endurance rides from structured ones. Intervals show as laps alternating hard and easy: short
+// hard laps are VO2 max work, long ones sweet spot.
+func classifyRide(w Workout) string {
+	const (
+		recoveryRide     = 45 * time.Minute
+		longRide         = 150 * time.Minute
+		vo2MaxLap        = 6 * time.Minute
+		intervalJumpRate = 0.25
+	)
+	duration := time.Duration(w.Duration) * time.Second
+
+	if len(w.Laps) >= 4 && countEffortJumps(w.Laps, intervalJumpRate) >= 3 {
+		// The hard laps are every other lap, their average length tells the kind of intervals
+		var hardLaps time.Duration
+		count := 0
+		for i := 1; i < len(w.Laps); i++ {
+			if lapEffort(w.Laps[i]) > lapEffort(w.Laps[i-1]) {
+				hardLaps += time.Duration(w.Laps[i].MovingTime) * time.Second
+				count++
+			}
+		}
+		if count > 0 && hardLaps/time.Duration(count) <= vo2MaxLap {
+			return "VO2 Max Ride 🔥🚴"
+		}
+		return "Sweet Spot Ride 🍯🚴"
+	}
+
+	if duration < recoveryRide {
+		return "Recovery Spin 🌀"
+	}
+	if duration >= longRide {
+		return "Long Endurance Ride 🚴☄️"
+	}
+	return "Endurance Ride 🚴🌄"
+}
+
+// classifySwim tells swim sets, with laps of changing pace, from steady swims.
+func classifySwim(w Workout) string {
+	const (
+		techniqueSwim = 1000
+		longSwim      = 3000
+		setJumpRate   = 0.15
+	)
+	if len(w.Laps) >= 4 && countEffortJumps(w.Laps, setJumpRate) >= 3 {
+		return "Swim Sets 🏊⏱️"
+	}
+	if w.Distance < techniqueSwim {
+		return "Technique Swim 🐟"
+	}
+	if w.Distance >= longSwim {
+		return "Long Swim 🐋"
+	}
+	return "Endurance Swim 🌊🏊"
+}
+
+func classifyHike(w Workout) string {
+	const mountainElevation = 500
+	if w.TotalElevationGain >= mountainElevation {
+		return "Mountain " + w.SportType + " 🏔️"
+	}
+	return "Easy " + w.SportType + " 🚶"
+}
+
+func classifyStrength(w Workout) string {
+	switch w.SportType {
+	case "Yoga", "Pilates":
+		return w.SportType + " Flow 🧘"
+	case "HighIntensityIntervalTraining", "Crossfit":
+		return "HIIT Session 🔥💪"
+	}
+	return "Strength Session 🏋️"
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The activities of the athletes are kept in the activities table, so recaps, analytics and comparisons read them
+// locally instead of asking Strava every time. Webhooks keep the store up to date with new, edited and deleted
+// activities, and every read first syncs the activities started since the last sync, which catches whatever a webhook
+// missed. An activity is stored as Strava returned it: the summary from the list of activities, replaced by the
+// detailed activity, with its laps and splits, once it was fetched.
+
+func createActivitiesTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS activities (
+		activity_id BIGINT PRIMARY KEY,
+		athlete_id BIGINT NOT NULL,
+		sport_type VARCHAR(32) NOT NULL,
+		start_date DATETIME NOT NULL,
+		detailed BOOLEAN NOT NULL,
+		data MEDIUMTEXT NOT NULL,
+		updated_at DATETIME NOT NULL,
+		INDEX (athlete_id, start_date)
+	);`)
+	return err
+}
+
+func createActivityStreamsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS activity_streams (
+		activity_id BIGINT PRIMARY KEY,
+		athlete_id BIGINT NOT NULL,
+		distance MEDIUMTEXT NOT NULL,
+		time MEDIUMTEXT NOT NULL,
+		INDEX (athlete_id)
+	);`)
+	return err
+}
+
+// createActivitySyncTable creates the sync cursors: the activities of an athlete started between synced_from and
+// synced_until are in the store.
+func createActivitySyncTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS activity_sync (
+		athlete_id BIGINT PRIMARY KEY,
+		synced_from DATETIME NOT NULL,
+		synced_until DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	);`)
+	return err
+}
+
+func openActivityStore() (*sql.DB, error) {
+	db, err := database()
+	if err != nil {
+		return nil, err
+	}
+	for _, create := range []func(*sql.DB) error{createActivitiesTable, createActivityStreamsTable, createActivitySyncTable} {
+		err = create(db)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// storeActivities adds the workouts to the store, or updates them. A summary never replaces a detailed activity, the
+// laps and splits would be lost.
+func storeActivities(workouts []Workout, detailed bool) error {
+	if len(workouts) == 0 {
+		return nil
+	}
+	db, err := openActivityStore()
+	if err != nil {
+		return err
+	}
+
+	for _, w := range workouts {
+		data, err := json.Marshal(w)
+		if err != nil {
+			return err
+		}
+		// data is assigned before detailed, MySQL updates the columns in order
+		_, err = db.Exec(`INSERT INTO activities (activity_id, athlete_id, sport_type, start_date, detailed, data, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE sport_type=VALUES(sport_type), start_date=VALUES(start_date),
+				data=IF(detailed AND NOT VALUES(detailed), data, VALUES(data)), detailed=detailed OR VALUES(detailed), updated_at=VALUES(updated_at);`,
+			w.ID, w.Athlete.ID, w.SportType, w.Date, detailed, string(data), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listStoredActivities returns the athlete's stored activities started between from (inclusive) and to (exclusive),
+// oldest first.
+func listStoredActivities(athleteID int, from time.Time, to time.Time) ([]Workout, error) {
+	db, err := openActivityStore()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT data FROM activities WHERE athlete_id=? AND start_date>=? AND start_date<? ORDER BY start_date;",
+		athleteID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workouts := []Workout{}
+	for rows.Next() {
+		var data string
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, err
+		}
+		var w Workout
+		err = json.Unmarshal([]byte(data), &w)
+		if err != nil {
+			return nil, err
+		}
+		workouts = append(workouts, w)
+	}
+	return workouts, rows.Err()
+}
+
+// storedActivity returns the stored activity, and whether it is the detailed one. It returns sql.ErrNoRows when the
+// activity isn't stored.
+func storedActivity(activityID int) (Workout, bool, error) {
+	db, err := openActivityStore()
+	if err != nil {
+		return Workout{}, false, err
+	}
+
+	var data string
+	var detailed bool
+	err = db.QueryRow("SELECT data, detailed FROM activities WHERE activity_id=?;", activityID).Scan(&data, &detailed)
+	if err != nil {
+		return Workout{}, false, err
+	}
+	var w Workout
+	err = json.Unmarshal([]byte(data), &w)
+	return w, detailed, err
+}
+
+// detailedActivity returns the detailed activity from the store, or fetches it from Strava, within the budget share
+// of the rate limits, and stores it along with its weather.
+func detailedActivity(activityID int, accessToken string, budgetShare float64) (Workout, error) {
+	workout, detailed, err := storedActivity(activityID)
+	if err == nil && detailed {
+		return workout, nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		fmt.Printf("Failed to read activity %d from the store, fetching it: %s\n", activityID, err)
+	}
+
+	waitForStravaBudget(budgetShare)
+	workout, err = fetchWorkout(activityID, accessToken)
+	if err != nil {
+		return Workout{}, err
+	}
+	workout = addWeather(workout, weatherProvider())
+	err = storeActivities([]Workout{workout}, true)
+	if err != nil {
+		fmt.Printf("Failed to store activity %d: %s\n", activityID, err)
+	}
+	return workout, nil
+}
+
+// updateStoredActivity applies a change made on Strava to the stored activity, if it's stored.
+func updateStoredActivity(activityID int, update func(w *Workout)) error {
+	w, _, err := storedActivity(activityID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	update(&w)
+
+	db, err := openActivityStore()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE activities SET sport_type=?, data=?, updated_at=? WHERE activity_id=?;",
+		w.SportType, string(data), time.Now(), activityID)
+	return err
+}
+
+// applyActivityUpdates applies the updates of a Strava webhook event to the activity, see
+// https://developers.strava.com/docs/webhooks/
+func applyActivityUpdates(w *Workout, updates map[string]string) {
+	for field, value := range updates {
+		switch field {
+		case "title":
+			w.Name = value
+		case "type":
+			// The event only has the legacy type, which is the sport type for the sports Stratonova knows
+			w.SportType = value
+		case "private":
+			w.Private = value == "true"
+		}
+	}
+}
+
+func deleteStoredActivity(activityID int) error {
+	db, err := openActivityStore()
+	if err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		"DELETE FROM activities WHERE activity_id=?;",
+		"DELETE FROM activity_streams WHERE activity_id=?;",
+	} {
+		_, err = db.Exec(query, activityID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedStreams returns the stored distance and time streams of the activity, sql.ErrNoRows when they aren't stored.
+func storedStreams(activityID int) ([]float64, []float64, error) {
+	db, err := openActivityStore()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var distanceData, timeData string
+	err = db.QueryRow("SELECT distance, time FROM activity_streams WHERE activity_id=?;", activityID).Scan(&distanceData, &timeData)
+	if err != nil {
+		return nil, nil, err
+	}
+	var distances, times []float64
+	err = json.Unmarshal([]byte(distanceData), &distances)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = json.Unmarshal([]byte(timeData), &times)
+	return distances, times, err
+}
+
+func storeStreams(athleteID int, activityID int, distances []float64, times []float64) error {
+	db, err := openActivityStore()
+	if err != nil {
+		return err
+	}
+
+	distanceData, err := json.Marshal(distances)
+	if err != nil {
+		return err
+	}
+	timeData, err := json.Marshal(times)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("REPLACE INTO activity_streams (activity_id, athlete_id, distance, time) VALUES (?, ?, ?, ?);",
+		activityID, athleteID, string(distanceData), string(timeData))
+	return err
+}
+
+// syncActivities brings the athlete's stored activities up to date with Strava from the given time: it lists the
+// activities started after the cursor, and the ones started before from when the store doesn't go back that far. A
+// first sync starts a year back, the history runs are compared with.
+func syncActivities(athleteID int, accessToken string, from time.Time) error {
+	db, err := openActivityStore()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var syncedFrom, syncedUntil time.Time
+	err = db.QueryRow("SELECT synced_from, synced_until FROM activity_sync WHERE athlete_id=?;", athleteID).Scan(&syncedFrom, &syncedUntil)
+	if err == sql.ErrNoRows {
+		syncedFrom, syncedUntil = now.Add(-historyWindow), now.Add(-historyWindow)
+	} else if err != nil {
+		return err
+	}
+	if from.Before(syncedFrom) {
+		older, err := fetchWorkoutsBetween(accessToken, from.Unix(), syncedFrom.Unix())
+		if err != nil {
+			return err
+		}
+		err = storeActivities(older, false)
+		if err != nil {
+			return err
+		}
+		syncedFrom = from
+	}
+
+	newer, err := fetchWorkoutsBetween(accessToken, syncedUntil.Unix(), now.Unix())
+	if err != nil {
+		return err
+	}
+	err = storeActivities(newer, false)
+	if err != nil {
+		return err
+	}
+	// The cursor is the start of the latest activity, not now: an activity uploaded late, started before the sync,
+	// would be skipped otherwise. The ones started before the latest activity are left to the webhooks.
+	for _, w := range newer {
+		if w.Date.After(syncedUntil) {
+			syncedUntil = w.Date
+		}
+	}
+
+	fmt.Printf("Synced %d activities of athlete %d\n", len(newer), athleteID)
+	_, err = db.Exec(`INSERT INTO activity_sync (athlete_id, synced_from, synced_until, updated_at) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE synced_from=VALUES(synced_from), synced_until=VALUES(synced_until), updated_at=VALUES(updated_at);`,
+		athleteID, syncedFrom, syncedUntil, now)
+	return err
+}
+
+// syncCovers reports whether a store synced back to syncedFrom, last at syncedAt, holds the activities started
+// between from and to. Activities can't have started after now.
+func syncCovers(syncedFrom time.Time, syncedAt time.Time, from time.Time, to time.Time, now time.Time) bool {
+	if to.After(now) {
+		to = now
+	}
+	return !syncedFrom.After(from) && !syncedAt.Before(to)
+}
+
+// storeCovers reports whether the athlete's store was synced over the whole of from to to, for when a sync failed.
+func storeCovers(athleteID int, from time.Time, to time.Time) (bool, error) {
+	db, err := openActivityStore()
+	if err != nil {
+		return false, err
+	}
+
+	var syncedFrom, syncedAt time.Time
+	err = db.QueryRow("SELECT synced_from, updated_at FROM activity_sync WHERE athlete_id=?;", athleteID).Scan(&syncedFrom, &syncedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return syncCovers(syncedFrom, syncedAt, from, to, time.Now()), nil
+}
+
+// activitiesBetween returns the athlete's activities started between from (inclusive) and to (exclusive) from the
+// store, synced with Strava first. When the sync fails the store is only read when an earlier sync covered the whole
+// range, otherwise the error is returned so the caller tries again later. When the store can't be read the activities
+// are fetched from Strava.
+func activitiesBetween(athleteID int, accessToken string, from time.Time, to time.Time) ([]Workout, error) {
+	err := syncActivities(athleteID, accessToken, from)
+	if err != nil {
+		covered, coverErr := storeCovers(athleteID, from, to)
+		if coverErr != nil {
+			fmt.Printf("Failed to read the activities of athlete %d from the store, fetching them: %s\n", athleteID, coverErr)
+			return fetchWorkoutsBetween(accessToken, from.Unix(), to.Unix())
+		}
+		if !covered {
+			return nil, fmt.Errorf("failed to sync the activities of athlete %d: %w", athleteID, err)
+		}
+		fmt.Printf("Failed to sync the activities of athlete %d, the store already covers them: %s\n", athleteID, err)
+	}
+	workouts, err := listStoredActivities(athleteID, from, to)
+	if err != nil {
+		fmt.Printf("Failed to read the activities of athlete %d from the store, fetching them: %s\n", athleteID, err)
+		return fetchWorkoutsBetween(accessToken, from.Unix(), to.Unix())
+	}
+	return workouts, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSyncCovers(t *testing.T) {
+	now := time.Date(2024, 5, 13, 7, 0, 0, 0, time.UTC)
+	weekStart := time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)
+	weekEnd := time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)
+	yearAgo := now.AddDate(-1, 0, 0)
+
+	tests := []struct {
+		name       string
+		syncedFrom time.Time
+		syncedAt   time.Time
+		from       time.Time
+		to         time.Time
+		want       bool
+	}{
+		{"synced after the week ended", yearAgo, weekEnd.Add(time.Hour), weekStart, weekEnd, true},
+		{"synced right at the end of the week", yearAgo, weekEnd, weekStart, weekEnd, true},
+		{"last synced during the week", yearAgo, weekEnd.Add(-24 * time.Hour), weekStart, weekEnd, false},
+		{"store doesn't go back far enough", weekStart.Add(time.Hour), weekEnd.Add(time.Hour), weekStart, weekEnd, false},
+		{"week in progress synced a minute ago", yearAgo, now.Add(-time.Minute), weekEnd, weekEnd.AddDate(0, 0, 7), false},
+		{"week in progress synced just now", yearAgo, now, weekEnd, weekEnd.AddDate(0, 0, 7), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := syncCovers(tt.syncedFrom, tt.syncedAt, tt.from, tt.to, now); got != tt.want {
+				t.Errorf("syncCovers() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
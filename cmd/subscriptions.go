@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const pushSubscriptionsURL = "https://www.strava.com/api/v3/push_subscriptions"
+
+// PushSubscription is a Strava webhook subscription. An application can have at most one.
+type PushSubscription struct {
+	ID          int       `json:"id"`
+	CallbackURL string    `json:"callback_url"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func webhookCallbackURL() string {
+	return config.Server.PublicBaseURL + "/webhook"
+}
+
+// doPushSubscriptionRequest sends a request to the push_subscriptions API and returns the response body.
+func doPushSubscriptionRequest(method string, requestURL string, form url.Values) ([]byte, error) {
+	// Create a new HTTP client
+	client := http.Client{}
+
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, requestURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	// Send the request
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Read the response body
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the response status code
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("request failed with status: %d, response: %s", resp.StatusCode, string(respBody))
+	}
+	return respBody, nil
+}
+
+func clientCredentials() url.Values {
+	params := url.Values{}
+	params.Set("client_id", config.Strava.ClientID)
+	params.Set("client_secret", config.Strava.ClientSecret)
+	return params
+}
+
+// createPushSubscription subscribes the callback URL to Strava webhook events. Strava validates the callback
+// synchronously, so the server must already be reachable on callbackURL.
+func createPushSubscription(callbackURL string) (PushSubscription, error) {
+	form := clientCredentials()
+	form.Set("callback_url", callbackURL)
+	form.Set("verify_token", config.Strava.VerifyToken)
+
+	body, err := doPushSubscriptionRequest("POST", pushSubscriptionsURL, form)
+	if err != nil {
+		return PushSubscription{}, err
+	}
+
+	subscription := PushSubscription{CallbackURL: callbackURL}
+	err = json.Unmarshal(body, &subscription)
+	if err != nil {
+		return PushSubscription{}, err
+	}
+	return subscription, nil
+}
+
+func listPushSubscriptions() ([]PushSubscription, error) {
+	body, err := doPushSubscriptionRequest("GET", pushSubscriptionsURL+"?"+clientCredentials().Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := []PushSubscription{}
+	err = json.Unmarshal(body, &subscriptions)
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+func deletePushSubscription(subscriptionID int) error {
+	_, err := doPushSubscriptionRequest("DELETE", fmt.Sprintf("%s/%d?%s", pushSubscriptionsURL, subscriptionID, clientCredentials().Encode()), nil)
+	return err
+}
+
+// verifyWebhookCallback performs the same validation request Strava sends when a subscription is created, and checks
+// the callback echoes the challenge back.
+func verifyWebhookCallback(callbackURL string) error {
+	challenge := strconv.FormatInt(time.Now().UnixNano(), 36)
+	params := url.Values{}
+	params.Set("hub.mode", "subscribe")
+	params.Set("hub.verify_token", config.Strava.VerifyToken)
+	params.Set("hub.challenge", challenge)
+
+	body, err := doPushSubscriptionRequest("GET", callbackURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("callback %s is not reachable: %w", callbackURL, err)
+	}
+
+	var resp map[string]string
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return fmt.Errorf("callback %s did not answer with JSON: %w", callbackURL, err)
+	}
+	if resp["hub.challenge"] != challenge {
+		return fmt.Errorf("callback %s did not echo the challenge back", callbackURL)
+	}
+	return nil
+}
+
+// subscriptionsHandler is the admin endpoint to manage the Strava push subscription:
+// GET lists, POST creates, DELETE ?id={id} deletes, and GET ?verify=true checks the callback.
+func subscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if r.URL.Query().Get("verify") == "true" {
+			err := verifyWebhookCallback(webhookCallbackURL())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			fmt.Fprintf(w, "Callback %s is reachable 🎉", webhookCallbackURL())
+			return
+		}
+
+		subscriptions, err := listPushSubscriptions()
+		if err != nil {
+			fmt.Println("Failed to list push subscriptions:", err)
+			http.Error(w, "Failed to list push subscriptions", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subscriptions)
+	case "POST":
+		subscription, err := createPushSubscription(webhookCallbackURL())
+		if err != nil {
+			fmt.Println("Failed to create push subscription:", err)
+			http.Error(w, "Failed to create push subscription", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subscription)
+	case "DELETE":
+		subscriptionID, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid subscription id 🙃🙃🙃: %s", err), http.StatusBadRequest)
+			return
+		}
+		err = deletePushSubscription(subscriptionID)
+		if err != nil {
+			fmt.Println("Failed to delete push subscription:", err)
+			http.Error(w, "Failed to delete push subscription", http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintf(w, "Subscription %d deleted successfully!", subscriptionID)
+	default:
+		http.Error(w, "Sorry, only GET, POST and DELETE are supported", http.StatusMethodNotAllowed)
+	}
+}
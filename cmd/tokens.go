@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// listAccessTokens returns the stored access token of every athlete.
+func listAccessTokens() ([]AccessToken, error) {
+	db, err := database()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT athlete_id, token, expires_at FROM strava_access_tokens ORDER BY athlete_id;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []AccessToken
+	for rows.Next() {
+		var token AccessToken
+		err = rows.Scan(&token.AthleteId, &token.Token, &token.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// refreshAccessToken trades the athlete's refresh token for a new access token, even if the current one is still
+// valid.
+func refreshAccessToken(athleteID int) (AccessTokenResponse, error) {
+	db, err := database()
+	if err != nil {
+		return AccessTokenResponse{}, err
+	}
+
+	refreshToken, err := getRefreshTokenFromSQL(db, athleteID)
+	if err != nil {
+		return AccessTokenResponse{}, err
+	}
+	newAccessToken, err := getTokenFromStrava("", refreshToken.RefreshToken)
+	if err != nil {
+		return AccessTokenResponse{}, fmt.Errorf("failed to refresh the token on strava: %w", err)
+	}
+	err = updateTokens(db, athleteID, newAccessToken)
+	if err != nil {
+		return AccessTokenResponse{}, err
+	}
+	return newAccessToken, nil
+}
+
+// revokeAthlete deauthorizes Stratonova on the athlete's Strava account and purges everything stored about them. An
+// athlete whose token was already revoked or expired can't be deauthorized, they are purged all the same.
+func revokeAthlete(athleteID int) error {
+	err := deauthorizeAthlete(athleteID)
+	if err != nil {
+		fmt.Printf("Failed to deauthorize athlete %d on Strava, purging their data anyway: %s\n", athleteID, err)
+	}
+	return purgeAthleteData(athleteID)
+}
+
+func deauthorizeAthlete(athleteID int) error {
+	// Create a new HTTP client
+	client := http.Client{}
+
+	accessToken, err := getAccessTokenForAthlete(athleteID)
+	if err != nil {
+		return err
+	}
+	form := url.Values{}
+	form.Set("access_token", accessToken)
+	req, err := http.NewRequest("POST", "https://www.strava.com/oauth/deauthorize", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Send the request
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Check the response status code
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("request failed with status: %d, response: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// purgeAthleteData deletes the athlete's tokens and everything Stratonova stored about them.
+func purgeAthleteData(athleteID int) error {
+	db, err := database()
+	if err != nil {
+		return err
+	}
+
+	err = createActivityHistoryTable(db)
+	if err != nil {
+		return err
+	}
+	err = createAthleteSettingsTable(db)
+	if err != nil {
+		return err
+	}
+	err = createPersonalRecordsTable(db)
+	if err != nil {
+		return err
+	}
+	err = createActivitiesTable(db)
+	if err != nil {
+		return err
+	}
+	err = createActivityStreamsTable(db)
+	if err != nil {
+		return err
+	}
+	err = createActivitySyncTable(db)
+	if err != nil {
+		return err
+	}
+	err = createRecapTables(db)
+	if err != nil {
+		return err
+	}
+	err = createPeriodRecapRunsTable(db)
+	if err != nil {
+		return err
+	}
+	err = createBackfillJobsTable(db)
+	if err != nil {
+		return err
+	}
+	err = createWebhookJobsTable(db)
+	if err != nil {
+		return err
+	}
+	err = createProcessedWebhookEventsTable(db)
+	if err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		"DELETE FROM strava_access_tokens WHERE athlete_id=?;",
+		"DELETE FROM strava_refresh_tokens WHERE athlete_id=?;",
+		"DELETE FROM strava_activity_history WHERE athlete_id=?;",
+		"DELETE FROM athlete_settings WHERE athlete_id=?;",
+		"DELETE FROM personal_records WHERE athlete_id=?;",
+		"DELETE FROM activities WHERE athlete_id=?;",
+		"DELETE FROM activity_streams WHERE athlete_id=?;",
+		"DELETE FROM activity_sync WHERE athlete_id=?;",
+		"DELETE FROM recap_schedules WHERE athlete_id=?;",
+		"DELETE FROM weekly_recap_runs WHERE athlete_id=?;",
+		"DELETE FROM period_recap_runs WHERE athlete_id=?;",
+		"DELETE FROM backfill_jobs WHERE athlete_id=?;",
+		"DELETE FROM backfill_activities WHERE athlete_id=?;",
+	} {
+		_, err = db.Exec(query, athleteID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The athlete's events are purged from the queue whatever their status, the dedupe keys of the events first since
+	// they are found through their jobs
+	_, err = db.Exec("DELETE FROM processed_webhook_events WHERE job_id IN (SELECT id FROM webhook_jobs WHERE JSON_EXTRACT(payload, '$.owner_id')=?);", athleteID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM webhook_jobs WHERE JSON_EXTRACT(payload, '$.owner_id')=?;", athleteID)
+	return err
+}
+
+// storeTokens saves the tokens of an athlete who authorized Stratonova, adding the athlete when they are new.
+func storeTokens(athleteID int, token AccessTokenResponse) error {
+	db, err := database()
+	if err != nil {
+		return err
+	}
+
+	var known int
+	err = db.QueryRow("SELECT COUNT(*) FROM strava_refresh_tokens WHERE athlete_id=?;", athleteID).Scan(&known)
+	if err != nil {
+		return err
+	}
+	if known > 0 {
+		return updateTokens(db, athleteID, token)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO strava_access_tokens (athlete_id, token, expires_at) VALUES (?, ?, ?);", athleteID, token.AccessToken, time.Unix(token.ExpiresAt, 0))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO strava_refresh_tokens (athlete_id, refresh_token) VALUES (?, ?);", athleteID, token.RefreshToken)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Weather providers, as configured in weather.provider. An empty provider turns weather off.
+const (
+	weatherProviderOpenMeteo = "open-meteo"
+	weatherProviderFixtures  = "fixtures"
+)
+
+const (
+	// heatAdjustFrom is the temperature, in °C, above which heat slows runners down.
+	heatAdjustFrom = 15.0
+	// heatSlowdownPerDegree is how much slower runners go for every degree above heatAdjustFrom.
+	heatSlowdownPerDegree = 0.004
+	// hotFrom, windyFrom (m/s) and rainyFrom (mm in the hour) are where the weather is worth a word in the summary.
+	hotFrom   = 25.0
+	windyFrom = 8.0
+	rainyFrom = 0.5
+)
+
+const (
+	// weatherForecastWindow is how far back the forecast endpoint is asked, the last 30 days. Older activities go to
+	// the archive, which only lags a few days behind.
+	weatherForecastWindow = 30 * 24 * time.Hour
+	weatherTimeout        = 10 * time.Second
+)
+
+// Weather is the weather at the start of an activity.
+type Weather struct {
+	// Temperature is in °C.
+	Temperature float64 `json:"temperature"`
+	// Humidity is the relative humidity in %.
+	Humidity float64 `json:"humidity"`
+	// WindSpeed is in m/s, at 10 m above ground.
+	WindSpeed float64 `json:"wind_speed"`
+	// Precipitation is the rain, or snow, of the hour in mm.
+	Precipitation float64 `json:"precipitation"`
+}
+
+// WeatherProvider looks up the weather at a place and time.
+type WeatherProvider interface {
+	Conditions(latitude float64, longitude float64, at time.Time) (Weather, error)
+}
+
+// weatherProvider returns the configured provider, nil when weather is turned off.
+func weatherProvider() WeatherProvider {
+	switch config.Weather.Provider {
+	case weatherProviderOpenMeteo:
+		return openMeteoProvider{baseURL: config.Weather.BaseURL, archiveURL: config.Weather.ArchiveURL}
+	case weatherProviderFixtures:
+		return fixtureWeatherProvider{dir: config.Weather.Fixtures}
+	}
+	return nil
+}
+
+// addWeather looks up the weather at the start of an outdoor activity with a GPS track, so it's stored with the
+// activity. The place of a private activity is never sent to the provider. An activity whose weather can't be looked
+// up is returned as it is.
+func addWeather(w Workout, provider WeatherProvider) Workout {
+	if provider == nil || w.Weather != nil || w.Trainer || len(w.StartLocation) != 2 || strings.HasPrefix(w.SportType, "Virtual") {
+		return w
+	}
+	if w.Private || w.Visibility == "only_me" {
+		return w
+	}
+	weather, err := provider.Conditions(w.StartLocation[0], w.StartLocation[1], w.Date)
+	if err != nil {
+		fmt.Printf("Failed to look up the weather of activity %d: %s\n", w.ID, err)
+		return w
+	}
+	w.Weather = &weather
+	return w
+}
+
+// openMeteoProvider looks up the weather with the Open-Meteo API, or any API answering the same way, see
+// https://open-meteo.com/en/docs and https://open-meteo.com/en/docs/historical-weather-api
+type openMeteoProvider struct {
+	baseURL    string
+	archiveURL string
+}
+
+func (p openMeteoProvider) Conditions(latitude float64, longitude float64, at time.Time) (Weather, error) {
+	query := url.Values{}
+	query.Set("latitude", fmt.Sprintf("%.4f", latitude))
+	query.Set("longitude", fmt.Sprintf("%.4f", longitude))
+	query.Set("hourly", "temperature_2m,relative_humidity_2m,wind_speed_10m,precipitation")
+	query.Set("wind_speed_unit", "ms")
+	query.Set("timezone", "GMT")
+	query.Set("start_date", at.UTC().Format(recapDateLayout))
+	query.Set("end_date", at.UTC().Format(recapDateLayout))
+
+	endpoint := p.baseURL
+	if time.Since(at) > weatherForecastWindow {
+		endpoint = p.archiveURL
+	}
+
+	client := http.Client{Timeout: weatherTimeout}
+	resp, err := client.Get(endpoint + "?" + query.Encode())
+	if err != nil {
+		return Weather{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Weather{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Weather{}, fmt.Errorf("request failed with status: %d, response: %s", resp.StatusCode, string(body))
+	}
+	return parseOpenMeteo(body, at)
+}
+
+// fixtureWeatherProvider answers with Open-Meteo responses saved in a directory, named after the place, rounded to
+// 2 decimals, and the UTC day, e.g. "41.39,2.17,2024-03-10.json". It lets the weather be tried without the network.
+type fixtureWeatherProvider struct {
+	dir string
+}
+
+func (p fixtureWeatherProvider) Conditions(latitude float64, longitude float64, at time.Time) (Weather, error) {
+	name := fmt.Sprintf("%.2f,%.2f,%s.json", latitude, longitude, at.UTC().Format(recapDateLayout))
+	body, err := os.ReadFile(filepath.Join(p.dir, name))
+	if err != nil {
+		return Weather{}, err
+	}
+	return parseOpenMeteo(body, at)
+}
+
+// parseOpenMeteo reads the weather of the hour the time falls in from an Open-Meteo response in GMT.
+func parseOpenMeteo(body []byte, at time.Time) (Weather, error) {
+	var response struct {
+		Hourly struct {
+			Time          []string  `json:"time"`
+			Temperature   []float64 `json:"temperature_2m"`
+			Humidity      []float64 `json:"relative_humidity_2m"`
+			WindSpeed     []float64 `json:"wind_speed_10m"`
+			Precipitation []float64 `json:"precipitation"`
+		} `json:"hourly"`
+	}
+	err := json.Unmarshal(body, &response)
+	if err != nil {
+		return Weather{}, err
+	}
+
+	hourly := response.Hourly
+	hour := at.UTC().Truncate(time.Hour).Format("2006-01-02T15:04")
+	for i, t := range hourly.Time {
+		if t != hour {
+			continue
+		}
+		if i >= len(hourly.Temperature) || i >= len(hourly.Humidity) || i >= len(hourly.WindSpeed) || i >= len(hourly.Precipitation) {
+			return Weather{}, fmt.Errorf("incomplete weather for %s", hour)
+		}
+		return Weather{
+			Temperature:   hourly.Temperature[i],
+			Humidity:      hourly.Humidity[i],
+			WindSpeed:     hourly.WindSpeed[i],
+			Precipitation: hourly.Precipitation[i],
+		}, nil
+	}
+	return Weather{}, fmt.Errorf("no weather for %s", hour)
+}
+
+// heatAdjustedSpeed is the speed the run would have been worth in cool weather.
+func heatAdjustedSpeed(metersPerSecond float64, temperature float64) float64 {
+	if temperature <= heatAdjustFrom {
+		return metersPerSecond
+	}
+	return metersPerSecond * (1 + (temperature-heatAdjustFrom)*heatSlowdownPerDegree)
+}
+
+// weatherDigest describes the weather of the activity for the prompts, e.g. "hot 29°C, 70% humidity, heat-adjusted
+// 4:48 /km" or "12°C, windy 32.4 km/h". It's empty when the weather is unknown.
+func weatherDigest(w Workout, loc Locale) string {
+	if w.Weather == nil {
+		return ""
+	}
+	weather := w.Weather
+	parts := []string{loc.temperature(weather.Temperature)}
+	if weather.Temperature >= hotFrom {
+		parts = []string{"hot " + loc.temperature(weather.Temperature), fmt.Sprintf("%.0f%% humidity", weather.Humidity)}
+	}
+	if weather.WindSpeed >= windyFrom {
+		parts = append(parts, "windy "+loc.speed(weather.WindSpeed))
+	}
+	if weather.Precipitation >= rainyFrom {
+		parts = append(parts, "rain "+loc.number(weather.Precipitation, 1)+" mm/h")
+	}
+	if discipline(w.SportType) == disciplineRun && w.AverageSpeed > 0 && weather.Temperature > heatAdjustFrom {
+		parts = append(parts, "heat-adjusted "+loc.pace(heatAdjustedSpeed(w.AverageSpeed, weather.Temperature)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// weatherInstructions asks the coach to comment on the weather, when some workouts have it.
+func weatherInstructions(workouts []Workout) string {
+	for _, w := range workouts {
+		if w.Weather != nil {
+			return " Mention the heat, wind or rain when they made a difference, and judge hot runs by their heat-adjusted pace."
+		}
+	}
+	return ""
+}
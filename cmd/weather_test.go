@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readWeatherFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", "weather", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestParseOpenMeteo(t *testing.T) {
+	madrid := time.FixedZone("CEST", 2*60*60)
+	tests := []struct {
+		name    string
+		fixture string
+		at      time.Time
+		want    Weather
+		wantErr bool
+	}{
+		{
+			name:    "start of the hour",
+			fixture: "41.39,2.17,2024-07-10.json",
+			at:      time.Date(2024, 7, 10, 5, 0, 0, 0, time.UTC),
+			want:    Weather{Temperature: 22.1, Humidity: 81, WindSpeed: 2.4, Precipitation: 0},
+		},
+		{
+			name:    "within the hour",
+			fixture: "41.39,2.17,2024-07-10.json",
+			at:      time.Date(2024, 7, 10, 7, 42, 0, 0, time.UTC),
+			want:    Weather{Temperature: 25.8, Humidity: 72, WindSpeed: 4.0, Precipitation: 0},
+		},
+		{
+			name:    "local time is read in GMT",
+			fixture: "41.39,2.17,2024-07-10.json",
+			at:      time.Date(2024, 7, 10, 10, 15, 0, 0, madrid),
+			want:    Weather{Temperature: 28.9, Humidity: 64, WindSpeed: 4.6, Precipitation: 0},
+		},
+		{
+			name:    "rain",
+			fixture: "52.37,4.90,2024-01-14.json",
+			at:      time.Date(2024, 1, 14, 10, 5, 0, 0, time.UTC),
+			want:    Weather{Temperature: 3.8, Humidity: 90, WindSpeed: 10.2, Precipitation: 0.8},
+		},
+		{
+			name:    "hour missing from the response",
+			fixture: "41.39,2.17,2024-07-10.json",
+			at:      time.Date(2024, 7, 10, 12, 0, 0, 0, time.UTC),
+			wantErr: true,
+		},
+		{
+			name:    "incomplete hour",
+			fixture: "52.37,4.90,2024-01-14.json",
+			at:      time.Date(2024, 1, 14, 11, 15, 0, 0, time.UTC),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseOpenMeteo(readWeatherFixture(t, tt.fixture), tt.at)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseOpenMeteo() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseOpenMeteo() failed: %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseOpenMeteo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("invalid JSON", func(t *testing.T) {
+		_, err := parseOpenMeteo([]byte(`{"hourly": [`), time.Date(2024, 7, 10, 5, 0, 0, 0, time.UTC))
+		if err == nil {
+			t.Error("parseOpenMeteo() didn't fail on invalid JSON")
+		}
+	})
+}
+
+func TestFixtureWeatherProvider(t *testing.T) {
+	provider := fixtureWeatherProvider{dir: filepath.Join("testdata", "weather")}
+
+	got, err := provider.Conditions(41.3851, 2.1734, time.Date(2024, 7, 10, 6, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Conditions() failed: %s", err)
+	}
+	if want := (Weather{Temperature: 23.4, Humidity: 78, WindSpeed: 3.1}); got != want {
+		t.Errorf("Conditions() = %+v, want %+v", got, want)
+	}
+
+	_, err = provider.Conditions(41.3851, 2.1734, time.Date(2024, 7, 11, 6, 30, 0, 0, time.UTC))
+	if err == nil {
+		t.Error("Conditions() didn't fail without a fixture for the day")
+	}
+}
+
+// openMeteoServer answers every hour of the requested day with the given temperature.
+func openMeteoServer(temperature float64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		day := r.URL.Query().Get("start_date")
+		var response struct {
+			Hourly struct {
+				Time          []string  `json:"time"`
+				Temperature   []float64 `json:"temperature_2m"`
+				Humidity      []float64 `json:"relative_humidity_2m"`
+				WindSpeed     []float64 `json:"wind_speed_10m"`
+				Precipitation []float64 `json:"precipitation"`
+			} `json:"hourly"`
+		}
+		for hour := 0; hour < 24; hour++ {
+			response.Hourly.Time = append(response.Hourly.Time, fmt.Sprintf("%sT%02d:00", day, hour))
+			response.Hourly.Temperature = append(response.Hourly.Temperature, temperature)
+			response.Hourly.Humidity = append(response.Hourly.Humidity, 50)
+			response.Hourly.WindSpeed = append(response.Hourly.WindSpeed, 1)
+			response.Hourly.Precipitation = append(response.Hourly.Precipitation, 0)
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+}
+
+func TestOpenMeteoProviderEndpoints(t *testing.T) {
+	forecast := openMeteoServer(20)
+	defer forecast.Close()
+	archive := openMeteoServer(10)
+	defer archive.Close()
+	provider := openMeteoProvider{baseURL: forecast.URL, archiveURL: archive.URL}
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want float64
+	}{
+		{"recent activity", time.Now().Add(-3 * time.Hour), 20},
+		{"activity within the forecast window", time.Now().Add(-weatherForecastWindow + 24*time.Hour), 20},
+		{"old activity", time.Now().Add(-weatherForecastWindow - 24*time.Hour), 10},
+		{"activity of another year", time.Date(2021, 4, 18, 8, 0, 0, 0, time.UTC), 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := provider.Conditions(41.39, 2.17, tt.at)
+			if err != nil {
+				t.Fatalf("Conditions() failed: %s", err)
+			}
+			if got.Temperature != tt.want {
+				t.Errorf("Conditions() came from the endpoint answering %.0f°C, want %.0f°C", got.Temperature, tt.want)
+			}
+		})
+	}
+}
+
+// stubWeatherProvider answers every lookup with the same weather, and counts them.
+type stubWeatherProvider struct {
+	weather Weather
+	calls   *int
+}
+
+func (p stubWeatherProvider) Conditions(latitude float64, longitude float64, at time.Time) (Weather, error) {
+	*p.calls++
+	return p.weather, nil
+}
+
+func TestAddWeather(t *testing.T) {
+	sunny := Weather{Temperature: 24, Humidity: 40, WindSpeed: 2}
+	outdoor := Workout{ID: 1, SportType: "Run", StartLocation: []float64{41.39, 2.17}, Visibility: "everyone"}
+	tests := []struct {
+		name   string
+		modify func(w *Workout)
+		looked bool
+	}{
+		{"outdoor activity", func(w *Workout) {}, true},
+		{"followers only", func(w *Workout) { w.Visibility = "followers_only" }, true},
+		{"private", func(w *Workout) { w.Private = true }, false},
+		{"only visible to the athlete", func(w *Workout) { w.Visibility = "only_me" }, false},
+		{"on a trainer", func(w *Workout) { w.Trainer = true }, false},
+		{"virtual", func(w *Workout) { w.SportType = "VirtualRide" }, false},
+		{"without a GPS track", func(w *Workout) { w.StartLocation = nil }, false},
+		{"weather already known", func(w *Workout) { w.Weather = &Weather{Temperature: 10} }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := outdoor
+			tt.modify(&w)
+			calls := 0
+			got := addWeather(w, stubWeatherProvider{weather: sunny, calls: &calls})
+			if looked := calls > 0; looked != tt.looked {
+				t.Fatalf("addWeather() looked the weather up: %t, want %t", looked, tt.looked)
+			}
+			if tt.looked && (got.Weather == nil || *got.Weather != sunny) {
+				t.Errorf("addWeather() set the weather to %+v, want %+v", got.Weather, sunny)
+			}
+		})
+	}
+
+	t.Run("weather turned off", func(t *testing.T) {
+		if got := addWeather(outdoor, nil); got.Weather != nil {
+			t.Errorf("addWeather() set the weather to %+v without a provider", got.Weather)
+		}
+	})
+}
+
+func TestHeatAdjustedSpeed(t *testing.T) {
+	tests := []struct {
+		speed       float64
+		temperature float64
+		want        float64
+	}{
+		{4, -5, 4},
+		{4, 10, 4},
+		{4, heatAdjustFrom, 4},
+		{4, 25, 4.16},
+		{3, 35, 3.24},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%.0f m/s at %.0f°C", tt.speed, tt.temperature), func(t *testing.T) {
+			if got := heatAdjustedSpeed(tt.speed, tt.temperature); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("heatAdjustedSpeed() = %f, want %f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeatherDigest(t *testing.T) {
+	metric := AthleteSettings{Language: "English", Units: unitsMetric}.locale()
+	imperial := AthleteSettings{Language: "English", Units: unitsImperial}.locale()
+	german := AthleteSettings{Language: "German", Units: unitsMetric}.locale()
+	fiveMinutesPerKm := 1000.0 / 300
+
+	tests := []struct {
+		name    string
+		workout Workout
+		loc     Locale
+		want    string
+	}{
+		{
+			name:    "unknown weather",
+			workout: Workout{SportType: "Run", AverageSpeed: fiveMinutesPerKm},
+			loc:     metric,
+			want:    "",
+		},
+		{
+			name:    "cool run",
+			workout: Workout{SportType: "Run", AverageSpeed: fiveMinutesPerKm, Weather: &Weather{Temperature: 12, Humidity: 80, WindSpeed: 3}},
+			loc:     metric,
+			want:    "12°C",
+		},
+		{
+			name:    "hot run",
+			workout: Workout{SportType: "Run", AverageSpeed: fiveMinutesPerKm, Weather: &Weather{Temperature: 29, Humidity: 70, WindSpeed: 2}},
+			loc:     metric,
+			want:    "hot 29°C, 70% humidity, heat-adjusted 4:44 /km",
+		},
+		{
+			name:    "windy and rainy ride",
+			workout: Workout{SportType: "Ride", AverageSpeed: 8, Weather: &Weather{Temperature: 12, Humidity: 95, WindSpeed: 9, Precipitation: 1.2}},
+			loc:     metric,
+			want:    "12°C, windy 32.4 km/h, rain 1.2 mm/h",
+		},
+		{
+			name:    "hot ride isn't heat-adjusted",
+			workout: Workout{SportType: "Ride", AverageSpeed: 8, Weather: &Weather{Temperature: 31, Humidity: 35}},
+			loc:     metric,
+			want:    "hot 31°C, 35% humidity",
+		},
+		{
+			name:    "warm run in imperial units",
+			workout: Workout{SportType: "Run", AverageSpeed: fiveMinutesPerKm, Weather: &Weather{Temperature: 20, Humidity: 60}},
+			loc:     imperial,
+			want:    "68°F, heat-adjusted 7:53 /mi",
+		},
+		{
+			name:    "decimal comma",
+			workout: Workout{SportType: "Ride", AverageSpeed: 7, Weather: &Weather{Temperature: 8.4, Humidity: 90, Precipitation: 0.5}},
+			loc:     german,
+			want:    "8°C, rain 0,5 mm/h",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := weatherDigest(tt.workout, tt.loc); got != tt.want {
+				t.Errorf("weatherDigest() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
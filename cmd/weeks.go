@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultWeekStart = time.Monday
+
+// parseStravaTimezone turns Strava's activity timezone, e.g. "(GMT+01:00) Europe/Madrid", into a location.
+func parseStravaTimezone(timezone string) (*time.Location, error) {
+	name := timezone
+	if i := strings.LastIndex(timezone, " "); i >= 0 {
+		name = timezone[i+1:]
+	}
+	return time.LoadLocation(name)
+}
+
+// localStartDate returns the wall-clock time the workout started at where the athlete was. Strava's
+// start_date_local carries the local time with a misleading UTC marker, so it is used as-is; the UTC start date in
+// the workout's timezone is the fallback.
+func localStartDate(w Workout) time.Time {
+	if !w.DateLocal.IsZero() {
+		return w.DateLocal
+	}
+	if loc, err := parseStravaTimezone(w.Timezone); err == nil {
+		return w.Date.In(loc)
+	}
+	return w.Date
+}
+
+// calendarWeek returns the start (inclusive) and end (exclusive) of the calendar week t falls in, for weeks that
+// start on weekStart. With the default of Monday these are ISO weeks.
+func calendarWeek(t time.Time, weekStart time.Weekday) (time.Time, time.Time) {
+	daysSinceStart := (int(t.Weekday()) - int(weekStart) + 7) % 7
+	start := time.Date(t.Year(), t.Month(), t.Day()-daysSinceStart, 0, 0, 0, 0, t.Location())
+	return start, start.AddDate(0, 0, 7)
+}
+
+// athleteCalendar returns the timezone and week start day the athlete's weeks are computed in. They come from the
+// athlete's recap schedule, or else the timezone of their latest activity on Strava, or else UTC.
+func athleteCalendar(athleteID int, accessToken string) (*time.Location, time.Weekday) {
+	db, err := database()
+	if err == nil {
+		var timezone string
+		var weekStart time.Weekday
+		err = createRecapTables(db)
+		if err == nil {
+			err = db.QueryRow("SELECT timezone, week_start FROM recap_schedules WHERE athlete_id=?;", athleteID).Scan(&timezone, &weekStart)
+		}
+		if err == nil {
+			if loc, err := time.LoadLocation(timezone); err == nil {
+				return loc, weekStart
+			}
+		}
+		if err != nil && err != sql.ErrNoRows {
+			fmt.Printf("Failed to read the recap schedule of athlete %d: %s\n", athleteID, err)
+		}
+	}
+
+	latest, err := fetchLatestWorkout(accessToken)
+	if err == nil {
+		if loc, err := parseStravaTimezone(latest.Timezone); err == nil {
+			return loc, defaultWeekStart
+		}
+	}
+	return time.UTC, defaultWeekStart
+}
+
+func fetchLatestWorkout(accessToken string) (Workout, error) {
+	// Create a new HTTP client
+	client := http.Client{}
+
+	req, err := http.NewRequest("GET", "https://www.strava.com/api/v3/athlete/activities?per_page=1", nil)
+	if err != nil {
+		return Workout{}, err
+	}
+
+	// Set the access token in the request header
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	// Send the request
+	resp, err := client.Do(req)
+	if err != nil {
+		return Workout{}, err
+	}
+	defer resp.Body.Close()
+	recordStravaRateLimit(resp.Header)
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Workout{}, err
+	}
+
+	// Check the response status code
+	if resp.StatusCode != http.StatusOK {
+		return Workout{}, fmt.Errorf("request failed with status: %d, response: %s", resp.StatusCode, string(body))
+	}
+
+	var workouts []Workout
+	err = json.Unmarshal(body, &workouts)
+	if err != nil {
+		return Workout{}, err
+	}
+	if len(workouts) == 0 {
+		return Workout{}, fmt.Errorf("athlete has no activities")
+	}
+	return workouts[0], nil
+}
+
+// fetchCurrentWeekWorkouts returns the athlete's workouts of the calendar week in progress, in their timezone.
+func fetchCurrentWeekWorkouts(athleteID int, accessToken string) ([]Workout, time.Time, time.Time, error) {
+	loc, weekStart := athleteCalendar(athleteID, accessToken)
+	now := time.Now().In(loc)
+	start, end := calendarWeek(now, weekStart)
+
+	workouts, err := activitiesBetween(athleteID, accessToken, start, now)
+	return workouts, start, end, err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("LoadLocation(%q) error = %v", name, err)
+	}
+	return loc
+}
+
+func TestCalendarWeek(t *testing.T) {
+	madrid := mustLoadLocation(t, "Europe/Madrid")
+
+	tests := []struct {
+		name      string
+		t         time.Time
+		weekStart time.Weekday
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{
+			name:      "mid week",
+			t:         time.Date(2024, 5, 8, 10, 0, 0, 0, time.UTC),
+			weekStart: time.Monday,
+			wantStart: time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "first moment of the week",
+			t:         time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC),
+			weekStart: time.Monday,
+			wantStart: time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "last moment of the week",
+			t:         time.Date(2024, 5, 12, 23, 59, 59, 0, time.UTC),
+			weekStart: time.Monday,
+			wantStart: time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "ISO week across the new year",
+			t:         time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC),
+			weekStart: time.Monday,
+			wantStart: time.Date(2024, 12, 30, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "Sunday week across the new year",
+			t:         time.Date(2024, 1, 6, 18, 0, 0, 0, time.UTC),
+			weekStart: time.Sunday,
+			wantStart: time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "Saturday week across a leap day",
+			t:         time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC),
+			weekStart: time.Saturday,
+			wantStart: time.Date(2024, 2, 24, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "in the athlete's timezone",
+			t:         time.Date(2024, 5, 12, 23, 30, 0, 0, time.UTC).In(madrid),
+			weekStart: time.Monday,
+			wantStart: time.Date(2024, 5, 13, 0, 0, 0, 0, madrid),
+			wantEnd:   time.Date(2024, 5, 20, 0, 0, 0, 0, madrid),
+		},
+		{
+			name:      "clocks go forward",
+			t:         time.Date(2024, 3, 30, 9, 0, 0, 0, madrid),
+			weekStart: time.Monday,
+			wantStart: time.Date(2024, 3, 25, 0, 0, 0, 0, madrid),
+			wantEnd:   time.Date(2024, 4, 1, 0, 0, 0, 0, madrid),
+		},
+		{
+			name:      "clocks go back",
+			t:         time.Date(2024, 10, 29, 9, 0, 0, 0, madrid),
+			weekStart: time.Sunday,
+			wantStart: time.Date(2024, 10, 27, 0, 0, 0, 0, madrid),
+			wantEnd:   time.Date(2024, 11, 3, 0, 0, 0, 0, madrid),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := calendarWeek(tt.t, tt.weekStart)
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("calendarWeek() = %s, %s, want %s, %s", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}